@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Modes of account deletion. Erasing removes everything the user did, while
+// anonymising keeps the comments left on others' posts, attributed to the
+// deleted user placeholder, so the conversations stay readable.
+const (
+	deletionErase     = "erase"
+	deletionAnonymise = "anonymise"
+)
+
+// deletedUserSub is the sub of the placeholder user the anonymised comments
+// are attributed to. It can't be returned by auth0, so nobody can log in as
+// this user.
+const deletedUserSub = "phototrail|deleted"
+
+// deleteAccount deletes a user and its content right away. The images that
+// aren't used by anybody else anymore are removed as well.
+func (s *service) deleteAccount(ctx context.Context, userID int, mode string) error {
+	tx, err := s.database.BeginTxx(ctx, nil)
+	if err != nil {
+		return wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	var paths []string
+	err = tx.SelectContext(ctx, &paths, `
+		select distinct i.path
+		from images as i
+		join posts as p on i.post_id = p.id
+		where p.user_id = ?
+	`, userID)
+	if err != nil {
+		return wrap(err, "querying images")
+	}
+
+	var exportIDs []int
+	err = tx.SelectContext(ctx, &exportIDs, `
+		select id
+		from exports
+		where user_id = ?
+	`, userID)
+	if err != nil {
+		return wrap(err, "querying exports")
+	}
+
+	if mode == deletionAnonymise {
+		_, err = tx.ExecContext(ctx, `
+			insert into users (sub, name)
+			values (?, 'deleted user')
+			on conflict do nothing
+		`, deletedUserSub)
+		if err != nil {
+			return wrap(err, "inserting deleted user placeholder")
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			update comments
+			set user_id = (select id from users where sub = ?)
+			where user_id = ?
+			and post_id not in (
+				select id
+				from posts
+				where user_id = ?
+			)
+		`, deletedUserSub, userID, userID)
+		if err != nil {
+			return wrap(err, "anonymising comments")
+		}
+	}
+
+	// Everything else the user did goes away with it.
+	res, err := tx.ExecContext(ctx, `
+		delete from users
+		where id = ?
+	`, userID)
+	if err != nil {
+		return wrap(err, "deleting user")
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return errUserNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return wrap(err, "committing transaction")
+	}
+
+	s.invalidateUser(userID)
+
+	// The files are removed once the deletion is committed, so a failure
+	// leaves unused files behind rather than posts without images. Those can
+	// still be collected later.
+	for _, path := range paths {
+		var count int
+		err = s.database.GetContext(ctx, &count, `
+			select count(*)
+			from images
+			where path = ?
+		`, path)
+		if err != nil {
+			return wrap(err, "counting image references")
+		}
+		if count != 0 {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(s.dataDir, "images", path))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return wrap(err, "removing image %s", path)
+		}
+	}
+
+	for _, exportID := range exportIDs {
+		err = os.Remove(s.exportPath(exportID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return wrap(err, "removing export %d", exportID)
+		}
+	}
+
+	return nil
+}
+
+// purgeAccounts deletes the accounts whose grace period is over, and returns
+// the number of accounts deleted.
+func (s *service) purgeAccounts(ctx context.Context) (int, error) {
+	var accounts []struct {
+		ID   int    `db:"id"`
+		Mode string `db:"deletion_mode"`
+	}
+	err := s.database.SelectContext(ctx, &accounts, `
+		select id, deletion_mode
+		from users
+		where deletion_scheduled_at <= current_timestamp
+	`)
+	if err != nil {
+		return 0, wrap(err, "querying scheduled deletions")
+	}
+
+	for i, a := range accounts {
+		err = s.deleteAccount(ctx, a.ID, a.Mode)
+		if err != nil {
+			return i, wrap(err, "deleting user %d", a.ID)
+		}
+		s.log(ctx).Info("deleted account", "user_id", a.ID, "mode", a.Mode)
+	}
+
+	return len(accounts), nil
+}
+
+// runDeletions purges the accounts due for deletion periodically, until the
+// context is closed.
+func (s *service) runDeletions(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		ctx, span := s.tracer.Start(ctx, "purge accounts")
+		_, err := s.purgeAccounts(ctx)
+		if err != nil {
+			s.log(ctx).Error("purging accounts", "err", err)
+		}
+		endSpan(span, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *service) deleteMe(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permDeleteAccount, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	var payload struct {
+		Mode string `json:"mode"`
+	}
+	err = decodePayload(r, &payload)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	switch payload.Mode {
+	case deletionErase, deletionAnonymise:
+	default:
+		s.writeError(w, r, http.StatusBadRequest, invalidField("mode", "invalid", fmt.Sprintf("unknown mode %q", payload.Mode)))
+		return
+	}
+
+	scheduledAt := time.Now().Add(s.deletionGracePeriod).UTC()
+	_, err = s.database.ExecContext(r.Context(), `
+		update users
+		set deletion_scheduled_at = ?, deletion_mode = ?
+		where id = ?
+	`, scheduledAt.Format(sqliteTime), payload.Mode, u.ID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "scheduling deletion"))
+		return
+	}
+
+	write(w, http.StatusAccepted, map[string]interface{}{
+		"deletion_scheduled_at": scheduledAt,
+		"deletion_mode":         payload.Mode,
+	})
+}
+
+func (s *service) cancelDeletion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permDeleteAccount, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	res, err := s.database.ExecContext(r.Context(), `
+		update users
+		set deletion_scheduled_at = null, deletion_mode = null
+		where id = ?
+		and deletion_scheduled_at is not null
+	`, u.ID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "cancelling deletion"))
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		s.writeError(w, r, http.StatusNotFound, &apiError{status: http.StatusNotFound, code: "deletion_not_scheduled", message: "no deletion scheduled"})
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+// scheduledDeletion returns the date the account of the user is scheduled for
+// deletion, if any.
+func (s *service) scheduledDeletion(ctx context.Context, userID int) (*time.Time, error) {
+	var scheduledAt sql.NullTime
+	err := s.database.GetContext(ctx, &scheduledAt, `
+		select deletion_scheduled_at
+		from users
+		where id = ?
+	`, userID)
+	if err != nil {
+		return nil, wrap(err, "querying deletion")
+	}
+	if !scheduledAt.Valid {
+		return nil, nil
+	}
+	return &scheduledAt.Time, nil
+}
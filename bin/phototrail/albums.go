@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type album struct {
+	ID            int            `json:"id"            db:"id"`
+	UserID        int            `json:"user_id"       db:"user_id"`
+	UserName      string         `json:"user_name"     db:"user_name"`
+	Title         string         `json:"title"         db:"title" validate:"trim,required,max=100"`
+	Description   string         `json:"description"   db:"description" validate:"trim,max=2000"`
+	Cover         string         `json:"cover"         db:"cover"`
+	CreatedAt     time.Time      `json:"created_at"    db:"created_at"`
+	Collaborators []collaborator `json:"collaborators" db:"-"`
+}
+
+type albumList struct {
+	Albums         []album `json:"albums"`
+	NextCursor     *cursor `json:"next_cursor,omitempty"`
+	PreviousCursor *cursor `json:"previous_cursor,omitempty"`
+}
+
+type collaborator struct {
+	AlbumID  int    `json:"-"         db:"album_id"`
+	UserID   int    `json:"user_id"   db:"user_id"`
+	UserName string `json:"user_name" db:"user_name"`
+}
+
+// errAlbumNotFound is returned when looking up an album that doesn't exist.
+var errAlbumNotFound = &apiError{status: http.StatusNotFound, code: "album_not_found", message: "album not found"}
+
+// subject returns the owner of a hydrated album and whether the user is one of
+// its collaborators, to check the user's permissions on the album.
+func (a album) subject(u user) subject {
+	sub := subject{OwnerID: a.UserID}
+	for _, c := range a.Collaborators {
+		if c.UserID == u.ID {
+			sub.Collaborator = true
+		}
+	}
+	return sub
+}
+
+// albumSubject returns the owner of the album and whether the user is one of
+// its collaborators, to check the user's permissions on the album.
+func (s *service) albumSubject(ctx context.Context, albumID int64, u user) (subject, error) {
+	var sub subject
+	var err error
+	sub.OwnerID, sub.Collaborator, err = s.store.AlbumMember(ctx, albumID, u.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, errAlbumNotFound
+	}
+	return sub, err
+}
+
+// parseAlbum reads and checks the album payload of a request. The cover is the
+// path of an image as returned by the upload endpoint, and is stored without
+// the images endpoint prefix.
+func (s *service) parseAlbum(r *http.Request) (album, error) {
+	var a album
+	err := decodePayload(r, &a)
+	if err != nil {
+		return a, err
+	}
+
+	if a.Cover == "" {
+		return a, nil
+	}
+	a.Cover = strings.TrimPrefix(a.Cover, "/images/")
+
+	exists, err := s.store.ImageExists(r.Context(), a.Cover)
+	if err != nil {
+		return a, internalError(err)
+	}
+	if !exists {
+		return a, invalidField("cover", "unknown", "unknown cover image")
+	}
+
+	return a, nil
+}
+
+// hydrateAlbums completes the albums with their collaborators and the full
+// path of their cover.
+func (s *service) hydrateAlbums(ctx context.Context, albums []album) error {
+	if len(albums) == 0 {
+		return nil
+	}
+
+	var albumIDs []int
+	for _, a := range albums {
+		albumIDs = append(albumIDs, a.ID)
+	}
+
+	collaborators, err := s.store.Collaborators(ctx, albumIDs)
+	if err != nil {
+		return err
+	}
+
+	for i, a := range albums {
+		a.Collaborators = collaborators[a.ID]
+		if a.Cover != "" {
+			a.Cover = filepath.Join("/images/", a.Cover)
+		}
+		albums[i] = a
+	}
+
+	return nil
+}
+
+func (s *service) listAlbums(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	pg, err := s.parsePage(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Only the albums the user owns or collaborates on are listed, even for
+	// the admins. They are paginated as the posts, by retrieving the IDs of
+	// the page first.
+	rows, err := s.store.UserAlbums(r.Context(), u.ID, pg)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	var l = albumList{Albums: []album{}}
+	rows, l.NextCursor, l.PreviousCursor = pg.cut(rows)
+	if len(rows) == 0 {
+		write(w, http.StatusOK, l)
+		return
+	}
+
+	var albumIDs = make([]int, len(rows))
+	for i, row := range rows {
+		albumIDs[i] = row.ID
+	}
+
+	l.Albums, err = s.store.Albums(r.Context(), albumIDs)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = s.hydrateAlbums(r.Context(), l.Albums)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "hydrating albums"))
+		return
+	}
+
+	write(w, http.StatusOK, l)
+}
+
+func (s *service) getAlbum(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	albums, err := s.store.Albums(r.Context(), []int{int(albumID)})
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(albums) == 0 {
+		s.writeError(w, r, http.StatusNotFound, errAlbumNotFound)
+		return
+	}
+
+	err = s.hydrateAlbums(r.Context(), albums)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "hydrating albums"))
+		return
+	}
+
+	err = authorize(u, permViewAlbum, albums[0].subject(u))
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	write(w, http.StatusOK, albums[0])
+}
+
+func (s *service) createAlbum(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permCreateAlbum, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	a, err := s.parseAlbum(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	albumID, err := s.store.CreateAlbum(r.Context(), u.ID, a)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "album_id": albumID})
+}
+
+func (s *service) updateAlbum(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	sub, err := s.albumSubject(r.Context(), albumID, u)
+	if errors.Is(err, errAlbumNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = authorize(u, permEditAlbum, sub)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	a, err := s.parseAlbum(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.store.UpdateAlbum(r.Context(), albumID, a)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (s *service) deleteAlbum(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	sub, err := s.albumSubject(r.Context(), albumID, u)
+	if errors.Is(err, errAlbumNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = authorize(u, permDeleteAlbum, sub)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	// Removing the album doesn't remove the posts, only their association
+	// with the album.
+	err = s.store.DeleteAlbum(r.Context(), albumID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (s *service) albumPosts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	sub, err := s.albumSubject(r.Context(), albumID, u)
+	if errors.Is(err, errAlbumNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = authorize(u, permViewAlbum, sub)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	pg, err := s.parsePage(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	f, err := s.listPosts(r.Context(), pg, `and id in (
+		select post_id
+		from album_posts
+		where album_id = ?
+	)`, albumID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "querying album posts"))
+		return
+	}
+
+	write(w, http.StatusOK, f)
+}
+
+func (s *service) addAlbumPost(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	var payload struct {
+		PostID int64 `json:"post_id" validate:"required"`
+	}
+	err = decodePayload(r, &payload)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	sub, err := s.albumSubject(r.Context(), albumID, u)
+	if errors.Is(err, errAlbumNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = authorize(u, permEditAlbumPosts, sub)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	err = s.store.AddAlbumPost(r.Context(), albumID, payload.PostID)
+	if isForeignKeyViolation(err) {
+		s.writeError(w, r, http.StatusNotFound, errPostNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (s *service) removeAlbumPost(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	postID, err := strconv.ParseInt(p.ByName("post_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("post_id", err))
+		return
+	}
+
+	sub, err := s.albumSubject(r.Context(), albumID, u)
+	if errors.Is(err, errAlbumNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = authorize(u, permEditAlbumPosts, sub)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	err = s.store.RemoveAlbumPost(r.Context(), albumID, postID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (s *service) addAlbumCollaborator(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	var payload struct {
+		UserID int64 `json:"user_id" validate:"required"`
+	}
+	err = decodePayload(r, &payload)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	sub, err := s.albumSubject(r.Context(), albumID, u)
+	if errors.Is(err, errAlbumNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = authorize(u, permShareAlbum, sub)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	err = s.store.AddCollaborator(r.Context(), albumID, payload.UserID)
+	if isForeignKeyViolation(err) {
+		s.writeError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (s *service) removeAlbumCollaborator(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	albumID, err := strconv.ParseInt(p.ByName("album_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("album_id", err))
+		return
+	}
+
+	userID, err := strconv.ParseInt(p.ByName("user_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("user_id", err))
+		return
+	}
+
+	sub, err := s.albumSubject(r.Context(), albumID, u)
+	if errors.Is(err, errAlbumNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Collaborators can leave an album on their own.
+	sub.UserID = int(userID)
+	err = authorize(u, permLeaveAlbum, sub)
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	err = s.store.RemoveCollaborator(r.Context(), albumID, userID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mattn/go-sqlite3"
+)
+
+// manifest describes the content of a backup archive. It is the last entry of
+// the archive, so it can list the checksums of everything before it.
+type manifest struct {
+	Version       string         `json:"version"`
+	CreatedAt     time.Time      `json:"created_at"`
+	SchemaVersion int            `json:"schema_version"`
+	Files         []manifestFile `json:"files"`
+	// Missing lists the images referenced by the database but absent from
+	// the data directory when the backup was taken.
+	Missing []string `json:"missing,omitempty"`
+}
+
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifestName is the name of the manifest in the backup archives.
+const manifestName = "manifest.json"
+
+// snapshotDatabase copies the database into the given file using SQLite's
+// online backup API, so the copy is consistent even if the database is being
+// written to.
+func (s *service) snapshotDatabase(ctx context.Context, path string) error {
+	conn, err := s.database.Conn(ctx)
+	if err != nil {
+		return wrap(err, "acquiring connection")
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		src, ok := unwrapConn(driverConn).(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+
+		raw, err := (&sqlite3.SQLiteDriver{}).Open(path)
+		if err != nil {
+			return wrap(err, "opening snapshot")
+		}
+		dst := raw.(*sqlite3.SQLiteConn)
+		defer dst.Close()
+
+		b, err := dst.Backup("main", src, "main")
+		if err != nil {
+			return wrap(err, "starting backup")
+		}
+
+		// Copy all the pages in a single step, which holds a read lock on
+		// the database for the duration of the copy.
+		_, err = b.Step(-1)
+		if err != nil {
+			b.Finish()
+			return wrap(err, "copying database")
+		}
+
+		err = b.Finish()
+		if err != nil {
+			return wrap(err, "finishing backup")
+		}
+		return nil
+	})
+}
+
+// errBackupUnsupported is returned when backing up or restoring a PostgreSQL
+// database, which is done with the tools of PostgreSQL.
+var errBackupUnsupported = &apiError{status: http.StatusNotImplemented, code: "backup_unsupported", message: "backups of PostgreSQL databases must be made with pg_dump and pg_restore"}
+
+// backup writes a gzipped tar archive of the data directory: a snapshot of the
+// database, the images it references, and a manifest with their checksums.
+func (s *service) backup(ctx context.Context, w io.Writer) (manifest, error) {
+	m := manifest{
+		Version:   Version,
+		CreatedAt: time.Now().UTC(),
+	}
+	if s.isPostgres() {
+		return m, errBackupUnsupported
+	}
+
+	tmp, err := ioutil.TempDir(s.dataDir, "backup-")
+	if err != nil {
+		return m, wrap(err, "creating temporary directory")
+	}
+	defer os.RemoveAll(tmp)
+
+	snapshot := filepath.Join(tmp, "database.sqlite")
+	err = s.snapshotDatabase(ctx, snapshot)
+	if err != nil {
+		return m, wrap(err, "taking database snapshot")
+	}
+
+	// The images to save are the ones referenced by the snapshot, not the
+	// live database, so the archive is consistent.
+	db, err := sqlx.Open("sqlite3", snapshot)
+	if err != nil {
+		return m, wrap(err, "opening snapshot")
+	}
+	defer db.Close()
+
+	err = db.GetContext(ctx, &m.SchemaVersion, `PRAGMA user_version`)
+	if err != nil {
+		return m, wrap(err, "querying schema version")
+	}
+
+	var paths []string
+	err = db.SelectContext(ctx, &paths, `
+		select distinct path
+		from images
+		order by path
+	`)
+	if err != nil {
+		return m, wrap(err, "querying images")
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	f, err := addFile(tw, snapshot, "database.sqlite")
+	if err != nil {
+		return m, err
+	}
+	m.Files = append(m.Files, f)
+
+	for _, path := range paths {
+		f, err := addFile(tw, filepath.Join(s.dataDir, "images", path), filepath.ToSlash(filepath.Join("images", path)))
+		if errors.Is(err, os.ErrNotExist) {
+			s.log(ctx).Warn("backing up missing image", "path", path)
+			m.Missing = append(m.Missing, path)
+			continue
+		}
+		if err != nil {
+			return m, err
+		}
+		m.Files = append(m.Files, f)
+	}
+
+	raw, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return m, wrap(err, "encoding manifest")
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(raw)),
+		ModTime: m.CreatedAt,
+	})
+	if err != nil {
+		return m, wrap(err, "writing manifest header")
+	}
+	_, err = tw.Write(raw)
+	if err != nil {
+		return m, wrap(err, "writing manifest")
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return m, wrap(err, "closing archive")
+	}
+	err = gz.Close()
+	if err != nil {
+		return m, wrap(err, "closing compression")
+	}
+
+	return m, nil
+}
+
+// addFile writes a file in the archive under the given name, and returns its
+// manifest entry.
+func addFile(tw *tar.Writer, path, name string) (manifestFile, error) {
+	f := manifestFile{Path: name}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return f, wrap(err, "opening %s", name)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return f, wrap(err, "reading %s", name)
+	}
+	f.Size = info.Size()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    f.Size,
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return f, wrap(err, "writing %s header", name)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tw, h), file)
+	if err != nil {
+		return f, wrap(err, "writing %s", name)
+	}
+	f.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+
+	return f, nil
+}
+
+// extractBackup extracts a backup archive in the given directory, and checks
+// its content against its manifest.
+func extractBackup(r io.Reader, dir string) (manifest, error) {
+	var m manifest
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return m, wrap(err, "opening compression")
+	}
+	tr := tar.NewReader(gz)
+
+	var files = make(map[string]manifestFile)
+	var found bool
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return m, wrap(err, "reading archive")
+		}
+
+		if header.Name == manifestName {
+			err = json.NewDecoder(tr).Decode(&m)
+			if err != nil {
+				return m, wrap(err, "parsing manifest")
+			}
+			found = true
+			continue
+		}
+
+		// Directories are created as needed for the files.
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		// Don't let a crafted archive write outside of the directory.
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if header.Typeflag != tar.TypeReg || filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return m, fmt.Errorf("unexpected entry %q", header.Name)
+		}
+
+		err = os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), os.ModeDir|0774)
+		if err != nil {
+			return m, wrap(err, "creating directory for %s", header.Name)
+		}
+
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0664)
+		if err != nil {
+			return m, wrap(err, "creating %s", header.Name)
+		}
+
+		h := sha256.New()
+		size, err := io.Copy(io.MultiWriter(file, h), tr)
+		file.Close()
+		if err != nil {
+			return m, wrap(err, "extracting %s", header.Name)
+		}
+
+		files[header.Name] = manifestFile{
+			Path:   header.Name,
+			Size:   size,
+			SHA256: fmt.Sprintf("%x", h.Sum(nil)),
+		}
+	}
+
+	if !found {
+		return m, errors.New("missing manifest")
+	}
+
+	for _, expected := range m.Files {
+		actual, ok := files[expected.Path]
+		if !ok {
+			return m, fmt.Errorf("missing file %s", expected.Path)
+		}
+		if actual != expected {
+			return m, fmt.Errorf("corrupted file %s", expected.Path)
+		}
+		delete(files, expected.Path)
+	}
+	for path := range files {
+		return m, fmt.Errorf("unexpected file %s", path)
+	}
+
+	return m, nil
+}
+
+// restore replaces the database and images of the data directory by the ones
+// of a backup archive. The archive is fully extracted and verified before
+// anything is replaced, and the replaced files are kept aside. It must not be
+// used while the server is running.
+func (s *service) restore(ctx context.Context, r io.Reader) (manifest, error) {
+	if s.isPostgres() {
+		return manifest{}, errBackupUnsupported
+	}
+
+	tmp, err := ioutil.TempDir(s.dataDir, "restore-")
+	if err != nil {
+		return manifest{}, wrap(err, "creating temporary directory")
+	}
+	defer os.RemoveAll(tmp)
+
+	m, err := extractBackup(r, tmp)
+	if err != nil {
+		return m, wrap(err, "verifying archive")
+	}
+
+	// Opening a missing database would create an empty one, which would
+	// then replace the current database.
+	var hasDatabase bool
+	for _, f := range m.Files {
+		if f.Path == "database.sqlite" {
+			hasDatabase = true
+		}
+	}
+	if !hasDatabase {
+		return m, errors.New("verifying archive: missing database")
+	}
+
+	if m.SchemaVersion > len(migrations) {
+		return m, fmt.Errorf("backup schema version %d is more recent than this binary's %d", m.SchemaVersion, len(migrations))
+	}
+
+	db, err := sqlx.Open("sqlite3", filepath.Join(tmp, "database.sqlite"))
+	if err != nil {
+		return m, wrap(err, "opening restored database")
+	}
+	var check string
+	err = db.GetContext(ctx, &check, `PRAGMA integrity_check`)
+	db.Close()
+	if err != nil {
+		return m, wrap(err, "checking restored database")
+	}
+	if check != "ok" {
+		return m, fmt.Errorf("restored database is corrupted: %s", check)
+	}
+
+	err = os.MkdirAll(filepath.Join(tmp, "images"), os.ModeDir|0774)
+	if err != nil {
+		return m, wrap(err, "creating images directory")
+	}
+
+	err = s.reader.Close()
+	if err != nil {
+		return m, wrap(err, "closing database")
+	}
+	err = s.database.Close()
+	if err != nil {
+		return m, wrap(err, "closing database")
+	}
+
+	suffix := ".pre-restore-" + time.Now().UTC().Format("20060102T150405")
+	err = swapFiles(s.dataDir, tmp, suffix,
+		[]string{"database.sqlite", "database.sqlite-wal", "database.sqlite-shm", "images"},
+		[]string{"database.sqlite", "images"},
+	)
+	if err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// swapFiles moves the current files of the directory aside, renamed with the
+// suffix, then the ones of the source directory in their place. If a move
+// fails, the ones already done are undone, so the directory is left as it
+// was.
+func swapFiles(dir, src, suffix string, current, replacements []string) (err error) {
+	var undo [][2]string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			rerr := os.Rename(undo[i][1], undo[i][0])
+			if rerr != nil {
+				err = fmt.Errorf("%w, and restoring %s failed: %s", err, undo[i][0], rerr)
+			}
+		}
+	}()
+
+	for _, name := range current {
+		from, to := filepath.Join(dir, name), filepath.Join(dir, name+suffix)
+		err = os.Rename(from, to)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return wrap(err, "moving %s aside", name)
+		}
+		undo = append(undo, [2]string{from, to})
+	}
+
+	for _, name := range replacements {
+		from, to := filepath.Join(src, name), filepath.Join(dir, name)
+		err = os.Rename(from, to)
+		if err != nil {
+			return wrap(err, "moving restored %s in place", name)
+		}
+		undo = append(undo, [2]string{from, to})
+	}
+
+	return nil
+}
+
+func (s *service) downloadBackup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permBackup, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	if s.isPostgres() {
+		s.writeError(w, r, http.StatusNotImplemented, errBackupUnsupported)
+		return
+	}
+
+	// The archive is written in a temporary file and only served once
+	// complete, as an error can't be reported once the response started,
+	// and the middlewares would finish a truncated archive as if it was
+	// complete.
+	file, err := ioutil.TempFile(s.dataDir, "backup-*.tar.gz")
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "creating temporary file"))
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	m, err := s.backup(r.Context(), file)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "backing up"))
+		return
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "rewinding backup"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="phototrail-%s.tar.gz"`, m.CreatedAt.Format("20060102T150405")))
+	http.ServeContent(w, r, "", m.CreatedAt, file)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		restored []string
+		err      bool
+		content  string
+	}{
+		{name: "complete", restored: []string{"database.sqlite", "images"}, content: "restored"},
+		{name: "failing", restored: []string{"database.sqlite"}, err: true, content: "current"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, src := t.TempDir(), t.TempDir()
+			mustWriteFile(t, filepath.Join(dir, "database.sqlite"), "current")
+			mustWriteFile(t, filepath.Join(dir, "images", "ab", "cdef"), "current")
+			for _, name := range tc.restored {
+				if name == "images" {
+					mustWriteFile(t, filepath.Join(src, "images", "ab", "cdef"), "restored")
+				} else {
+					mustWriteFile(t, filepath.Join(src, name), "restored")
+				}
+			}
+
+			err := swapFiles(dir, src, ".old", []string{"database.sqlite", "database.sqlite-wal", "images"}, []string{"database.sqlite", "images"})
+			if tc.err != (err != nil) {
+				t.Fatalf("got error %v, expected an error: %t", err, tc.err)
+			}
+
+			for _, name := range []string{"database.sqlite", filepath.Join("images", "ab", "cdef")} {
+				raw, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatalf("reading %s: %s", name, err)
+				}
+				if string(raw) != tc.content {
+					t.Errorf("got %s %q, expected %q", name, raw, tc.content)
+				}
+			}
+
+			// The replaced files are only kept aside if the swap succeeded.
+			_, err = os.Stat(filepath.Join(dir, "database.sqlite.old"))
+			if tc.err != os.IsNotExist(err) {
+				t.Errorf("got replaced database %v, expected it to be kept: %t", err, !tc.err)
+			}
+		})
+	}
+}
+
+func TestDownloadBackup(t *testing.T) {
+	s := newTestService(t)
+	admin := user{ID: 1, Name: "admin", Role: roleAdmin}
+	s.cache.SetDefault("Bearer admin", admin)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	s.downloadBackup(w, r, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	m, err := extractBackup(w.Body, t.TempDir())
+	if err != nil {
+		t.Fatalf("extracting backup: %s", err)
+	}
+	if len(m.Files) != 1 || m.Files[0].Path != "database.sqlite" {
+		t.Errorf("got files %+v, expected the database", m.Files)
+	}
+
+	// The temporary archive is removed once served.
+	matches, err := filepath.Glob(filepath.Join(s.dataDir, "backup-*"))
+	if err != nil {
+		t.Fatalf("listing temporary files: %s", err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("got temporary files %v, expected none", matches)
+	}
+}
+
+// mustWriteFile writes a file and its directories, or fails the test.
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatalf("creating directory of %s: %s", path, err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("writing %s: %s", path, err)
+	}
+}
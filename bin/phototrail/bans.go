@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// sqliteTime is the layout of SQLite's current_timestamp, which must be used
+// for the dates compared to it.
+const sqliteTime = "2006-01-02 15:04:05"
+
+// checkRestrictions returns an error if the user is banned or currently
+// suspended.
+func checkRestrictions(u user) error {
+	if u.BannedAt != nil {
+		return &apiError{status: http.StatusForbidden, code: "user_banned", message: "user is banned"}
+	}
+	if u.SuspendedUntil != nil && time.Now().Before(*u.SuspendedUntil) {
+		return &apiError{status: http.StatusForbidden, code: "user_suspended", message: fmt.Sprintf("user is suspended until %s", u.SuspendedUntil.Format(time.RFC3339))}
+	}
+	return nil
+}
+
+// restrictedFilter returns the condition to add to a query to leave out the
+// content of banned and suspended users, if the service is configured to hide
+// it. The column is the one holding the author of the content.
+func (s *service) restrictedFilter(column string) string {
+	return restrictedFilter(s.hideRestricted, column)
+}
+
+// restrictedFilter returns the condition leaving out the content of banned
+// and suspended users, or nothing if it mustn't be hidden.
+func restrictedFilter(hide bool, column string) string {
+	if !hide {
+		return ""
+	}
+	return fmt.Sprintf(`and %s not in (
+		select id
+		from users
+		where banned_at is not null
+		or suspended_until > current_timestamp
+	)`, column)
+}
+
+// invalidateUser removes the cached authentications of the user, so the next
+// request of the user reads its state from the database again.
+func (s *service) invalidateUser(userID int) {
+	for header, item := range s.cache.Items() {
+		if u, ok := item.Object.(user); ok && u.ID == userID {
+			s.cache.Delete(header)
+		}
+	}
+}
+
+// restrictUser bans the user if until is nil, or suspends it until the given
+// date, and records the action in the moderation log. A nil moderator is used
+// for the actions done outside of the API.
+func (s *service) restrictUser(ctx context.Context, moderatorID *int, userID int, until *time.Time, reason string) error {
+	err := s.store.RestrictUser(ctx, moderatorID, userID, until, reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	s.invalidateUser(userID)
+	return nil
+}
+
+// liftRestrictions clears the ban or suspension of a user, and records the
+// action in the moderation log.
+func (s *service) liftRestrictions(ctx context.Context, moderatorID *int, userID int, reason string) error {
+	err := s.store.LiftRestrictions(ctx, moderatorID, userID, reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	s.invalidateUser(userID)
+	return nil
+}
+
+// errUserNotFound is returned when acting on a user that doesn't exist.
+var errUserNotFound = &apiError{status: http.StatusNotFound, code: "user_not_found", message: "user not found"}
+
+func (s *service) banUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permBanUser, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	userID, err := strconv.ParseInt(p.ByName("user_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("user_id", err))
+		return
+	}
+
+	var payload struct {
+		Reason string     `json:"reason" validate:"trim,required,max=1000"`
+		Until  *time.Time `json:"until"`
+	}
+	err = decodePayload(r, &payload)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if payload.Until != nil && !payload.Until.After(time.Now()) {
+		s.writeError(w, r, http.StatusBadRequest, invalidField("until", "invalid", "suspension must end in the future"))
+		return
+	}
+
+	err = s.restrictUser(r.Context(), &u.ID, int(userID), payload.Until, payload.Reason)
+	if errors.Is(err, errUserNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "restricting user"))
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (s *service) unbanUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permBanUser, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	userID, err := strconv.ParseInt(p.ByName("user_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("user_id", err))
+		return
+	}
+
+	var payload struct {
+		Reason string `json:"reason" validate:"trim,required,max=1000"`
+	}
+	err = decodePayload(r, &payload)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.liftRestrictions(r.Context(), &u.ID, int(userID), payload.Reason)
+	if errors.Is(err, errUserNotFound) {
+		s.writeError(w, r, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "lifting user restrictions"))
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
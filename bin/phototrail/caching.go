@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// cachedPage is a response of a list kept in the page cache, along with the
+// content version it was computed at.
+type cachedPage struct {
+	version uint64
+	raw     []byte
+}
+
+// notModified answers with a 304 if the client already has the response
+// computed at the given content version.
+func (s *service) notModified(w http.ResponseWriter, r *http.Request, version uint64) bool {
+	etag := contentETag(version)
+	for _, header := range r.Header.Values("If-None-Match") {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				setValidators(w, version)
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contentETag returns the validator of the responses computed at a content
+// version. It is weak, as the responses are compressed or not depending on
+// the client.
+func contentETag(version uint64) string {
+	return fmt.Sprintf(`W/"%x"`, version)
+}
+
+// setValidators sets the headers of a response computed at a content
+// version. The responses are only cached by the clients, as they require
+// authentication, and must be revalidated each time.
+func setValidators(w http.ResponseWriter, version uint64) {
+	w.Header().Set("ETag", contentETag(version))
+	w.Header().Set("Cache-Control", "private, no-cache")
+}
+
+// cachedResponse writes the response of the request from the page cache, if
+// it was computed at the current content version.
+func (s *service) cachedResponse(w http.ResponseWriter, r *http.Request, version uint64) bool {
+	if s.pageCacheTTL == 0 {
+		return false
+	}
+
+	v, ok := s.pages.Get(pageKey(r))
+	if !ok || v.(cachedPage).version != version {
+		s.metrics.pageCache.WithLabelValues("miss").Inc()
+		return false
+	}
+
+	s.metrics.pageCache.WithLabelValues("hit").Inc()
+	setValidators(w, version)
+	writeRaw(w, http.StatusOK, v.(cachedPage).raw)
+	return true
+}
+
+// writeCached writes the payload of the request, and keeps it in the page
+// cache if it is enabled.
+func (s *service) writeCached(w http.ResponseWriter, r *http.Request, version uint64, payload interface{}) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+
+	// The version is read before the response is computed, so a response
+	// outdated by a concurrent write is kept at the previous version, and is
+	// no longer served once the write is committed.
+	if s.pageCacheTTL != 0 {
+		s.pages.SetDefault(pageKey(r), cachedPage{version: version, raw: raw})
+	}
+
+	setValidators(w, version)
+	writeRaw(w, http.StatusOK, raw)
+}
+
+// pageKey returns the key of a request in the page cache. The parameters are
+// sorted, so their order doesn't matter.
+func pageKey(r *http.Request) string {
+	return r.URL.Path + "?" + r.URL.Query().Encode()
+}
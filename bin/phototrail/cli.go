@@ -0,0 +1,520 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commands lists the administration commands of the binary, with their usage.
+var commands = []struct {
+	name  string
+	usage string
+	run   func(s *service, ctx context.Context, args []string) error
+}{
+	{"migrate", "migrate", (*service).migrateCommand},
+	{"config print", "config print", (*service).configPrintCommand},
+	{"user list", "user list", (*service).userListCommand},
+	{"user ban", "user ban <user> [reason]", (*service).userBanCommand},
+	{"user suspend", "user suspend <user> <duration> [reason]", (*service).userSuspendCommand},
+	{"user unban", "user unban <user> [reason]", (*service).userUnbanCommand},
+	{"user delete", "user delete <user> <erase|anonymise>", (*service).userDeleteCommand},
+	{"user promote", "user promote <user> <user|moderator|admin>", (*service).userPromoteCommand},
+	{"user quota", "user quota <user> <bytes|default>", (*service).userQuotaCommand},
+	{"import", "import <user> <instagram|google> <file>", (*service).importCommand},
+	{"post delete", "post delete <post id>", (*service).postDeleteCommand},
+	{"images gc", "images gc [grace period]", (*service).imagesGCCommand},
+	{"usage recompute", "usage recompute", (*service).usageRecomputeCommand},
+	{"db vacuum", "db vacuum", (*service).dbVacuumCommand},
+	{"stats", "stats", (*service).statsCommand},
+	{"backup", "backup <file>", (*service).backupCommand},
+	{"restore", "restore <file>", (*service).restoreCommand},
+}
+
+// command runs the administration command designated by the arguments. Users
+// are designated either by their ID or their auth0 sub.
+func (s *service) command(ctx context.Context, args []string) error {
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != c.name {
+			continue
+		}
+		return c.run(s, ctx, args[len(words):])
+	}
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+// findUser resolves a user designated by its ID or sub. The subs of the
+// identity provider are never plain numbers, and comparing an integer column
+// to a string is an error in PostgreSQL, so the column is chosen from the
+// reference.
+func (s *service) findUser(ctx context.Context, ref string) (user, error) {
+	column, arg := "sub", interface{}(ref)
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		column, arg = "id", id
+	}
+
+	var u user
+	err := s.database.GetContext(ctx, &u, fmt.Sprintf(`
+		select id, sub, name, role
+		from users
+		where %s = ?
+	`, column), arg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, fmt.Errorf("user %q not found", ref)
+	}
+	if err != nil {
+		return u, wrap(err, "finding user")
+	}
+	return u, nil
+}
+
+func (s *service) migrateCommand(ctx context.Context, args []string) error {
+	version, err := s.migrate(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println("database schema at version", version)
+	return nil
+}
+
+func (s *service) userListCommand(ctx context.Context, args []string) error {
+	var users []struct {
+		user
+		BanReason sql.NullString `db:"ban_reason"`
+	}
+	err := s.database.SelectContext(ctx, &users, `
+		select id, sub, name, role, banned_at, suspended_until, ban_reason
+		from users
+		order by id
+	`)
+	if err != nil {
+		return wrap(err, "querying users")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSUB\tNAME\tROLE\tRESTRICTION")
+	for _, u := range users {
+		restriction := "none"
+		if err := checkRestrictions(u.user); err != nil {
+			restriction = fmt.Sprintf("%s: %s", err, u.BanReason.String)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", u.ID, u.Sub, u.Name, u.Role, restriction)
+	}
+	return w.Flush()
+}
+
+func (s *service) userBanCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing user")
+	}
+
+	u, err := s.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	err = s.restrictUser(ctx, nil, u.ID, nil, strings.Join(args[1:], " "))
+	if err != nil {
+		return wrap(err, "banning user")
+	}
+
+	fmt.Printf("user %d (%s) banned\n", u.ID, u.Name)
+	return nil
+}
+
+func (s *service) userSuspendCommand(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("expected a user and a duration")
+	}
+
+	u, err := s.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(args[1])
+	if err != nil {
+		return wrap(err, "parsing duration")
+	}
+	until := time.Now().Add(duration)
+
+	err = s.restrictUser(ctx, nil, u.ID, &until, strings.Join(args[2:], " "))
+	if err != nil {
+		return wrap(err, "suspending user")
+	}
+
+	fmt.Printf("user %d (%s) suspended until %s\n", u.ID, u.Name, until.Format(time.RFC3339))
+	return nil
+}
+
+func (s *service) userUnbanCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing user")
+	}
+
+	u, err := s.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	err = s.liftRestrictions(ctx, nil, u.ID, strings.Join(args[1:], " "))
+	if err != nil {
+		return wrap(err, "unbanning user")
+	}
+
+	fmt.Printf("user %d (%s) unbanned\n", u.ID, u.Name)
+	return nil
+}
+
+func (s *service) userPromoteCommand(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected a user and a role")
+	}
+
+	u, err := s.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	role := args[1]
+	switch role {
+	case roleUser, roleModerator, roleAdmin:
+	default:
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	err = s.store.SetUserRole(ctx, u.ID, role)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("user %d (%s) is now %s\n", u.ID, u.Name, role)
+	return nil
+}
+
+func (s *service) userQuotaCommand(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected a user and a quota")
+	}
+
+	u, err := s.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	// The quota is stored as null when the default applies, so the users
+	// follow the changes of the default.
+	var quota *int64
+	if args[1] != "default" {
+		q, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || q < 0 {
+			return fmt.Errorf("invalid quota %q", args[1])
+		}
+		quota = &q
+	}
+
+	err = s.store.SetStorageQuota(ctx, u.ID, quota)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case quota == nil:
+		fmt.Printf("user %d (%s) now has the default quota\n", u.ID, u.Name)
+	case *quota == 0:
+		fmt.Printf("user %d (%s) now has no quota\n", u.ID, u.Name)
+	default:
+		fmt.Printf("user %d (%s) now has a quota of %d bytes\n", u.ID, u.Name, *quota)
+	}
+	return nil
+}
+
+func (s *service) userDeleteCommand(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected a user and a mode")
+	}
+
+	u, err := s.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	mode := args[1]
+	switch mode {
+	case deletionErase, deletionAnonymise:
+	default:
+		return fmt.Errorf("unknown mode %q", mode)
+	}
+
+	err = s.deleteAccount(ctx, u.ID, mode)
+	if err != nil {
+		return wrap(err, "deleting user")
+	}
+
+	fmt.Printf("user %d (%s) deleted\n", u.ID, u.Name)
+	return nil
+}
+
+func (s *service) postDeleteCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("missing post id")
+	}
+
+	postID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return wrap(err, "parsing post id")
+	}
+
+	res, err := s.database.ExecContext(ctx, `
+		delete from posts
+		where id = ?
+	`, postID)
+	if err != nil {
+		return wrap(err, "deleting post")
+	}
+
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("post %d not found", postID)
+	}
+
+	fmt.Printf("post %d deleted\n", postID)
+	return nil
+}
+
+func (s *service) importCommand(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return errors.New("expected a user, a source and an archive file")
+	}
+
+	u, err := s.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	parse, ok := importers[args[1]]
+	if !ok {
+		return fmt.Errorf("unknown source %q", args[1])
+	}
+
+	zr, err := zip.OpenReader(args[2])
+	if err != nil {
+		return wrap(err, "opening archive")
+	}
+	defer zr.Close()
+
+	items, err := parse(&zr.Reader)
+	if err != nil {
+		return wrap(err, "parsing archive")
+	}
+
+	imported, skipped, err := s.importArchive(ctx, u, args[1], items, &zr.Reader)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d posts imported for user %d (%s), %d skipped\n", imported, u.ID, u.Name, skipped)
+	return nil
+}
+
+// defaultImagesGCGrace is the age under which the images gc command keeps the
+// unreferenced files.
+const defaultImagesGCGrace = time.Hour
+
+// collectImages removes the image files that aren't referenced by any post
+// anymore, and returns the number of files and bytes freed. The server writes
+// the files of the uploads before referencing them, so the files modified
+// within the grace period are kept, as they can be uploads in progress.
+func (s *service) collectImages(ctx context.Context, grace time.Duration) (int, int64, error) {
+	// The cutoff is taken before the references are read, so only the
+	// uploads taking longer than the grace period to reference their file
+	// could lose it.
+	cutoff := time.Now().Add(-grace)
+
+	var paths []string
+	err := s.database.SelectContext(ctx, &paths, `
+		select distinct path
+		from images
+	`)
+	if err != nil {
+		return 0, 0, wrap(err, "querying images")
+	}
+
+	var referenced = make(map[string]bool)
+	for _, path := range paths {
+		referenced[path] = true
+	}
+
+	root := filepath.Join(s.dataDir, "images")
+	var count int
+	var size int64
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if referenced[rel] || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return wrap(err, "removing %s", rel)
+		}
+		count++
+		size += info.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return count, size, wrap(err, "walking images directory")
+	}
+
+	return count, size, nil
+}
+
+func (s *service) imagesGCCommand(ctx context.Context, args []string) error {
+	grace := defaultImagesGCGrace
+	if len(args) > 0 {
+		var err error
+		grace, err = time.ParseDuration(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid grace period %q", args[0])
+		}
+	}
+
+	count, size, err := s.collectImages(ctx, grace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d unreferenced images removed, %d bytes freed\n", count, size)
+	return nil
+}
+
+func (s *service) usageRecomputeCommand(ctx context.Context, args []string) error {
+	count, err := s.recomputeImageSizes(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d image sizes updated\n", count)
+	return nil
+}
+
+func (s *service) dbVacuumCommand(ctx context.Context, args []string) error {
+	_, err := s.database.ExecContext(ctx, `VACUUM`)
+	if err != nil {
+		return wrap(err, "vacuuming database")
+	}
+	fmt.Println("database vacuumed")
+	return nil
+}
+
+func (s *service) statsCommand(ctx context.Context, args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, table := range []string{"users", "posts", "images", "likes", "comments", "albums", "reports"} {
+		var count int
+		err := s.database.GetContext(ctx, &count, fmt.Sprintf(`select count(*) from %s`, table))
+		if err != nil {
+			return wrap(err, "counting %s", table)
+		}
+		fmt.Fprintf(w, "%s\t%d\n", table, count)
+	}
+
+	// The size of a PostgreSQL database is only known to its server.
+	if !s.isPostgres() {
+		info, err := os.Stat(filepath.Join(s.dataDir, "database.sqlite"))
+		if err != nil {
+			return wrap(err, "reading database size")
+		}
+		fmt.Fprintf(w, "database size\t%d\n", info.Size())
+	}
+
+	var size int64
+	err := filepath.Walk(filepath.Join(s.dataDir, "images"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return wrap(err, "reading images size")
+	}
+	fmt.Fprintf(w, "images size\t%d\n", size)
+
+	return w.Flush()
+}
+
+func (s *service) backupCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("missing archive file")
+	}
+
+	// Write in a temporary file first, so a failed backup doesn't leave a
+	// truncated archive behind.
+	tmp := args[0] + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return wrap(err, "creating archive")
+	}
+	defer os.Remove(tmp)
+
+	m, err := s.backup(ctx, file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return wrap(err, "closing archive")
+	}
+
+	err = os.Rename(tmp, args[0])
+	if err != nil {
+		return wrap(err, "moving archive")
+	}
+
+	fmt.Printf("%d files backed up to %s, %d missing images\n", len(m.Files), args[0], len(m.Missing))
+	return nil
+}
+
+func (s *service) restoreCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("missing archive file")
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return wrap(err, "opening archive")
+	}
+	defer file.Close()
+
+	m, err := s.restore(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d files restored from the backup of %s, schema at version %d\n", len(m.Files), m.CreatedAt.Format(time.RFC3339), m.SchemaVersion)
+	if m.SchemaVersion < len(migrations) {
+		fmt.Println("the database schema is outdated, run the migrate command")
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// secretOptions are the options whose value must never be printed.
+var secretOptions = map[string]bool{
+	"auth-client-secret": true,
+	"database-url":       true,
+}
+
+// envName returns the name of the environment variable of an option.
+func envName(option string) string {
+	return "PHOTOTRAIL_" + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+// loadConfig completes the options given on the command line with the ones
+// from the environment and the config file. Command line options take
+// precedence over the environment, which takes precedence over the config
+// file.
+func (s *service) loadConfig(fs *flag.FlagSet) error {
+	var explicit = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if !explicit["config"] {
+		if path, ok := os.LookupEnv(envName("config")); ok {
+			s.configFile = path
+		}
+	}
+
+	var values = make(map[string]string)
+	var sources = make(map[string]string)
+
+	if s.configFile != "" {
+		var file map[string]interface{}
+		_, err := toml.DecodeFile(s.configFile, &file)
+		if err != nil {
+			return wrap(err, "reading config file")
+		}
+
+		var keys []string
+		for key := range file {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if key == "config" || fs.Lookup(key) == nil {
+				return fmt.Errorf("unknown option %q in config file", key)
+			}
+			values[key] = fmt.Sprint(file[key])
+			sources[key] = "config file"
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+
+		// Secrets can be read from a file instead of the environment, which
+		// is how most orchestrators provide them.
+		name := envName(f.Name)
+		if path, ok := os.LookupEnv(name + "_FILE"); ok {
+			raw, readErr := ioutil.ReadFile(path)
+			if readErr != nil {
+				err = wrap(readErr, "reading %s_FILE", name)
+				return
+			}
+			values[f.Name] = strings.TrimRight(string(raw), "\r\n")
+			sources[f.Name] = name + "_FILE"
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			values[f.Name] = value
+			sources[f.Name] = name
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		if explicit[name] {
+			continue
+		}
+		err := fs.Set(name, value)
+		if err != nil {
+			return wrap(err, "invalid value for %s from %s", name, sources[name])
+		}
+	}
+
+	return nil
+}
+
+// validate checks the configuration of the service.
+func (s *service) validate() error {
+	if s.bind == "" {
+		return errors.New("missing bind address")
+	}
+	if s.dataDir == "" {
+		return errors.New("missing data directory")
+	}
+	if s.authDomain != "" {
+		u, err := url.Parse(s.authDomain)
+		if err != nil {
+			return wrap(err, "parsing auth domain")
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("auth domain %q must be an absolute URL", s.authDomain)
+		}
+	}
+	if s.deletionGracePeriod < 0 {
+		return errors.New("deletion grace period can't be negative")
+	}
+	if s.databaseURL != "" && !strings.HasPrefix(s.databaseURL, "postgres://") && !strings.HasPrefix(s.databaseURL, "postgresql://") {
+		return errors.New("only postgres:// database URLs are supported")
+	}
+	if s.databaseReaders < 1 {
+		return errors.New("at least one database reader is needed")
+	}
+	if s.storageQuotaDefault < 0 {
+		return errors.New("storage quota can't be negative")
+	}
+	return nil
+}
+
+func (s *service) configPrintCommand(ctx context.Context, args []string) error {
+	s.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "version" {
+			return
+		}
+
+		value := f.Value.String()
+		if secretOptions[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+
+		// Values are printed so the output can be used as a config file.
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch getter.Get().(type) {
+			case bool, int, int64, uint, uint64, float64:
+				fmt.Printf("%s = %s\n", f.Name, value)
+				return
+			}
+		}
+		fmt.Printf("%s = %s\n", f.Name, strconv.Quote(value))
+	})
+	return nil
+}
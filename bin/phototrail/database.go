@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// busyRetries is the number of attempts of a write on a busy database.
+const busyRetries = 5
+
+// retryBusy runs the function again while it fails because the database is
+// locked by another connection, with an increasing delay. The busy timeout of
+// the connections already waits for the locks in most cases, but not when a
+// transaction was started by another process, like an administration command.
+func retryBusy(ctx context.Context, fn func() error) error {
+	delay := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := fn()
+
+		var sqliteErr sqlite3.Error
+		if !errors.As(err, &sqliteErr) || (sqliteErr.Code != sqlite3.ErrBusy && sqliteErr.Code != sqlite3.ErrLocked) {
+			return err
+		}
+		if attempt == busyRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// insertID inserts a row and returns its ID. SQLite gives the ID of the last
+// row inserted by the connection, while PostgreSQL must return it from the
+// statement.
+func insertID(ctx context.Context, db sqlx.ExtContext, query string, args ...interface{}) (int64, error) {
+	if db.DriverName() == "postgres" {
+		var id int64
+		err := sqlx.GetContext(ctx, db, &id, query+" returning id", args...)
+		return id, err
+	}
+
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// isForeignKeyViolation tells if a statement failed because it references a
+// row that doesn't exist, or doesn't anymore.
+func isForeignKeyViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// queryObserver is called after each statement executed on the database, with
+// the statement, the time it started and its error if any.
+type queryObserver func(ctx context.Context, query string, start time.Time, err error)
+
+// observedConnector opens connections whose statements are reported to an
+// observer. The statements are timed until the driver returns, which for
+// queries doesn't include reading the rows. The connections of the writer
+// also retry the writes refused because the database is busy. The statements
+// are written with question mark placeholders, which are rewritten for the
+// drivers using another bind type.
+type observedConnector struct {
+	dsn     string
+	driver  driver.Driver
+	observe queryObserver
+	retry   bool
+	bind    int
+}
+
+func (c observedConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &observedConn{Conn: conn, observe: c.observe, retry: c.retry, bind: c.bind}, nil
+}
+
+func (c observedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// observedConn wraps a driver connection, exposing the optional interfaces of
+// the connections of the sqlite3 and postgres drivers.
+type observedConn struct {
+	driver.Conn
+	observe queryObserver
+	retry   bool
+	bind    int
+
+	// The statements of a transaction can't be retried alone, only the
+	// beginning of the transaction is.
+	inTx bool
+}
+
+// unwrapConn returns the connection of the driver behind an observed
+// connection, for the code that needs to use it directly.
+func unwrapConn(conn interface{}) interface{} {
+	if c, ok := conn.(*observedConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+func (c *observedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *observedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	query = sqlx.Rebind(c.bind, query)
+
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &observedStmt{Stmt: stmt, query: query, observe: c.observe}, nil
+}
+
+func (c *observedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	begin := func() (err error) {
+		if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+			tx, err = beginner.BeginTx(ctx, opts)
+		} else {
+			tx, err = c.Conn.Begin()
+		}
+		return err
+	}
+
+	var err error
+	if c.retry {
+		err = retryBusy(ctx, begin)
+	} else {
+		err = begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.inTx = true
+	return &observedTx{Tx: tx, conn: c}, nil
+}
+
+// observedTx wraps a transaction, to know when it's over.
+type observedTx struct {
+	driver.Tx
+	conn *observedConn
+}
+
+func (t *observedTx) Commit() error {
+	t.conn.inTx = false
+	return t.Tx.Commit()
+}
+
+func (t *observedTx) Rollback() error {
+	t.conn.inTx = false
+	return t.Tx.Rollback()
+}
+
+func (c *observedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	query = sqlx.Rebind(c.bind, query)
+
+	var res driver.Result
+	exec := func() (err error) {
+		start := time.Now()
+		res, err = execer.ExecContext(ctx, query, args)
+		if err != driver.ErrSkip {
+			c.observe(ctx, query, start, err)
+		}
+		return err
+	}
+
+	var err error
+	if c.retry && !c.inTx {
+		err = retryBusy(ctx, exec)
+	} else {
+		err = exec()
+	}
+	return res, err
+}
+
+func (c *observedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	query = sqlx.Rebind(c.bind, query)
+
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.observe(ctx, query, start, err)
+	}
+	return rows, err
+}
+
+func (c *observedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *observedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+// observedStmt wraps a prepared statement.
+type observedStmt struct {
+	driver.Stmt
+	query   string
+	observe queryObserver
+}
+
+func (s *observedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var res driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = execer.ExecContext(ctx, args)
+	} else {
+		res, err = s.Stmt.Exec(namedValues(args))
+	}
+	s.observe(ctx, s.query, start, err)
+	return res, err
+}
+
+func (s *observedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(args))
+	}
+	s.observe(ctx, s.query, start, err)
+	return rows, err
+}
+
+// namedValues converts the arguments for the drivers without context support.
+func namedValues(args []driver.NamedValue) []driver.Value {
+	var values = make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// queryOperation returns the operation of a statement, its first keyword.
+func queryOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToLower(fields[0])
+}
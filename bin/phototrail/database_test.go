@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// benchmarkFeed measures the reads of the first page of the feed, with the
+// given number of goroutines creating posts meanwhile.
+func benchmarkFeed(b *testing.B, writers int) {
+	s := newTestService(b)
+	ctx := context.Background()
+
+	userID, err := s.store.CreateUser(ctx, "sub", "alice")
+	if err != nil {
+		b.Fatalf("creating user: %s", err)
+	}
+	for i := 0; i < 1000; i++ {
+		_, _, _, err = s.store.CreatePost(ctx, userID, post{Text: "#bench post"}, true)
+		if err != nil {
+			b.Fatalf("creating post: %s", err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, _, _, err := s.store.CreatePost(ctx, userID, post{Text: "#bench post"}, true)
+				if err != nil {
+					b.Errorf("creating post: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := s.listPosts(ctx, page{limit: 20}, "")
+			if err != nil {
+				b.Errorf("listing posts: %s", err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkFeed(b *testing.B) {
+	benchmarkFeed(b, 0)
+}
+
+// BenchmarkFeedWithWrites shows the reads don't wait for the writer.
+func BenchmarkFeedWithWrites(b *testing.B) {
+	benchmarkFeed(b, 4)
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import "syscall"
+
+// freeSpace returns the space available to the process on the filesystem of
+// the path, in bytes.
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// freeSpace isn't supported on this platform.
+func freeSpace(path string) (uint64, error) {
+	return 0, errUnsupported
+}
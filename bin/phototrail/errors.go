@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiError is an error the clients of the API can act on. The code is stable
+// and meant for programs, while the message is meant for humans. The cause is
+// logged but never given to the client.
+type apiError struct {
+	status  int
+	code    string
+	message string
+	fields  []fieldError
+	cause   error
+}
+
+func (e *apiError) Error() string {
+	if e.cause == nil {
+		return e.message
+	}
+	return e.message + ": " + e.cause.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.cause
+}
+
+// fieldError details why a parameter or a field of a payload is invalid.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// statusCodes are the codes of the errors that aren't errors of the API,
+// depending on the status they are answered with.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusBadGateway:            "upstream_failed",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+var (
+	errMissingToken    = &apiError{status: http.StatusUnauthorized, code: "missing_token", message: "missing access token"}
+	errInvalidToken    = &apiError{status: http.StatusUnauthorized, code: "invalid_token", message: "invalid or expired access token"}
+	errPostNotFound    = &apiError{status: http.StatusNotFound, code: "post_not_found", message: "post not found"}
+	errCommentNotFound = &apiError{status: http.StatusNotFound, code: "comment_not_found", message: "comment not found"}
+	errEmptyPost       = &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_payload",
+		message: "missing text or images",
+		fields:  []fieldError{{Field: "text", Code: "required", Message: "missing text or images"}},
+	}
+)
+
+// internalError hides an unexpected error from the client.
+func internalError(err error) error {
+	return &apiError{status: http.StatusInternalServerError, code: "internal_error", message: "internal error", cause: err}
+}
+
+// upstreamError is returned when a service the API relies on fails.
+func upstreamError(name string, err error) error {
+	return &apiError{status: http.StatusBadGateway, code: "upstream_failed", message: name + " unavailable", cause: err}
+}
+
+// invalidParameter is returned when a parameter of the path or the query
+// string can't be parsed.
+func invalidParameter(name string, err error) error {
+	// The errors of strconv repeat the function and the value, only their
+	// reason is useful.
+	message := err.Error()
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		message = numErr.Err.Error()
+	}
+
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_parameter",
+		message: fmt.Sprintf("invalid %s parameter: %s", name, message),
+		fields:  []fieldError{{Field: name, Code: "invalid", Message: message}},
+		cause:   err,
+	}
+}
+
+// invalidPayload is returned when the payload of a request can't be decoded.
+func invalidPayload(err error) error {
+	// The type errors name the Go types, so they are described in terms of
+	// JSON instead.
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		message := fmt.Sprintf("unexpected %s", typeErr.Value)
+		return &apiError{
+			status:  http.StatusBadRequest,
+			code:    "invalid_payload",
+			message: fmt.Sprintf("invalid payload: %s for %s", message, typeErr.Field),
+			fields:  []fieldError{{Field: typeErr.Field, Code: "invalid_type", Message: message}},
+			cause:   err,
+		}
+	}
+
+	// The unknown fields are only reported in the message of the error.
+	if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+		name, _ = strconv.Unquote(name)
+		return &apiError{
+			status:  http.StatusBadRequest,
+			code:    "invalid_payload",
+			message: fmt.Sprintf("invalid payload: unknown field %s", name),
+			fields:  []fieldError{{Field: name, Code: "unknown", Message: "unknown field"}},
+			cause:   err,
+		}
+	}
+
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_payload",
+		message: "invalid payload: " + err.Error(),
+		cause:   err,
+	}
+}
+
+// invalidField is returned when a field of a payload isn't valid.
+func invalidField(field, code, message string) error {
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_payload",
+		message: message,
+		fields:  []fieldError{{Field: field, Code: code, Message: message}},
+	}
+}
+
+// Error type for API return values. The message is kept under the error key
+// for the older clients.
+type Error struct {
+	Err       string       `json:"error"`
+	Code      string       `json:"code"`
+	Fields    []fieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// newError returns the payload of an error answered with a status, and the
+// status to answer with. The errors of the API replace the status by their
+// own. The others are given the code of the status, and their message is
+// hidden if the failure is internal.
+func newError(ctx context.Context, status int, err error) (int, Error) {
+	payload := Error{
+		Err:       err.Error(),
+		Code:      statusCodes[status],
+		RequestID: requestID(ctx),
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		status = apiErr.status
+		payload.Err = apiErr.message
+		payload.Code = apiErr.code
+		payload.Fields = apiErr.fields
+	} else if status >= http.StatusInternalServerError {
+		payload.Err = "internal error"
+		payload.Code = "internal_error"
+	}
+	return status, payload
+}
+
+// writeError writes an error and a status to the ResponseWriter, as described
+// by newError. The internal failures are logged.
+func (s *service) writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	status, payload := newError(r.Context(), status, err)
+	if status >= http.StatusInternalServerError {
+		s.log(r.Context()).Error("answering with an error", "status", status, "err", err)
+	}
+
+	write(w, status, payload)
+}
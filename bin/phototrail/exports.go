@@ -0,0 +1,482 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Status of the exports.
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+type export struct {
+	ID          int        `json:"id"           db:"id"`
+	UserID      int        `json:"-"            db:"user_id"`
+	Status      string     `json:"status"       db:"status"`
+	Error       string     `json:"error"        db:"error"`
+	CreatedAt   time.Time  `json:"created_at"   db:"created_at"`
+	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
+}
+
+// takeout is the content of the manifest of an export.
+type takeout struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	Profile    takeoutProfile    `json:"profile"`
+	Posts      []post            `json:"posts"`
+	Comments   []takeoutComment  `json:"comments"`
+	Likes      []takeoutPostLink `json:"likes"`
+}
+
+type takeoutProfile struct {
+	ID   int    `json:"id"   db:"id"`
+	Sub  string `json:"sub"  db:"sub"`
+	Name string `json:"name" db:"name"`
+	Role string `json:"role" db:"role"`
+}
+
+// takeoutComment is a comment of the user, on any post.
+type takeoutComment struct {
+	ID        int       `json:"id"         db:"id"`
+	PostID    int       `json:"post_id"    db:"post_id"`
+	Text      string    `json:"text"       db:"text"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// takeoutPostLink is a reference to a post of any user.
+type takeoutPostLink struct {
+	PostID   int    `json:"post_id"   db:"post_id"`
+	UserName string `json:"user_name" db:"user_name"`
+}
+
+// exportPath returns the path of the archive of an export.
+func (s *service) exportPath(exportID int) string {
+	return filepath.Join(s.dataDir, "exports", fmt.Sprintf("%d.zip", exportID))
+}
+
+// failInterruptedExports marks the exports left pending by a previous run of
+// the server as failed, so their users can request a new one.
+func (s *service) failInterruptedExports(ctx context.Context) error {
+	return s.store.FailPendingExports(ctx)
+}
+
+// runExport builds the archive of an export and records the outcome. It is
+// meant to run in the background, independently of the request that started
+// it.
+func (s *service) runExport(ctx context.Context, exportID int, userID int) {
+	ctx, span := s.tracer.Start(ctx, "export", trace.WithAttributes(attribute.Int("export_id", exportID)))
+	defer span.End()
+
+	// The error of the export is shown to the user, so only the message of
+	// the errors of the API is kept, the others are logged.
+	status, message := exportReady, ""
+	err := s.buildExport(ctx, exportID, userID)
+	if err != nil {
+		s.log(ctx).Error("building export", "export_id", exportID, "err", err)
+		_, payload := newError(ctx, http.StatusInternalServerError, err)
+		status, message = exportFailed, payload.Err
+	}
+
+	err = s.store.CompleteExport(ctx, exportID, status, message)
+	if err != nil {
+		s.log(ctx).Error("updating export", "export_id", exportID, "err", err)
+	}
+}
+
+// buildExport writes the archive of the user's data: a JSON manifest, an HTML
+// index to browse it, and the images of the user's posts.
+func (s *service) buildExport(ctx context.Context, exportID int, userID int) error {
+	t := takeout{
+		ExportedAt: time.Now().UTC(),
+	}
+
+	var err error
+	t.Profile, err = s.store.TakeoutProfile(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	t.Posts, err = s.exportPosts(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	t.Comments, err = s.store.TakeoutComments(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	t.Likes, err = s.store.TakeoutLikes(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	// The images are referenced relatively to the root of the archive, so
+	// the index can be browsed once extracted.
+	var images []string
+	for i := range t.Posts {
+		for j, image := range t.Posts[i].Images {
+			image = strings.TrimPrefix(image, "/")
+			t.Posts[i].Images[j] = image
+			images = append(images, image)
+		}
+	}
+
+	path := s.exportPath(exportID)
+	err = os.MkdirAll(filepath.Dir(path), os.ModeDir|0774)
+	if err != nil {
+		return wrap(err, "creating exports directory")
+	}
+
+	// Write in a temporary file first, so a failed export doesn't leave a
+	// truncated archive behind.
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return wrap(err, "creating archive")
+	}
+	defer os.Remove(path + ".tmp")
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "manifest.json",
+		Method:   zip.Deflate,
+		Modified: t.ExportedAt,
+	})
+	if err != nil {
+		return wrap(err, "creating manifest")
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	err = encoder.Encode(t)
+	if err != nil {
+		return wrap(err, "writing manifest")
+	}
+
+	w, err = zw.CreateHeader(&zip.FileHeader{
+		Name:     "index.html",
+		Method:   zip.Deflate,
+		Modified: t.ExportedAt,
+	})
+	if err != nil {
+		return wrap(err, "creating index")
+	}
+	err = takeoutIndex.Execute(w, t)
+	if err != nil {
+		return wrap(err, "writing index")
+	}
+
+	for _, image := range images {
+		err = addExportFile(zw, filepath.Join(s.dataDir, filepath.FromSlash(image)), image)
+		if errors.Is(err, os.ErrNotExist) {
+			s.log(ctx).Warn("exporting missing image", "path", image)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return wrap(err, "closing archive")
+	}
+	err = file.Close()
+	if err != nil {
+		return wrap(err, "closing archive file")
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return wrap(err, "moving archive")
+	}
+
+	return nil
+}
+
+// exportPosts returns all the posts of the user with their comments. Unlike
+// hydratePosts, it ignores the moderation: the hidden posts and comments, and
+// the comments of the restricted users, are part of the user's data too.
+func (s *service) exportPosts(ctx context.Context, userID int) ([]post, error) {
+	posts, err := s.store.TakeoutPosts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(posts) == 0 {
+		return nil, nil
+	}
+
+	postIDs := make([]int, len(posts))
+	for i, p := range posts {
+		postIDs[i] = p.ID
+	}
+
+	comments, err := s.store.TakeoutPostComments(ctx, postIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := s.store.Images(ctx, postIDs)
+	if err != nil {
+		return nil, err
+	}
+	likes, err := s.store.Likes(ctx, postIDs)
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.queryEntities(ctx, postIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range posts {
+		for j, c := range comments[p.ID] {
+			c.Tags = e.tags[entityKey{PostID: c.PostID, CommentID: c.ID}]
+			c.Mentions = e.mentions[entityKey{PostID: c.PostID, CommentID: c.ID}]
+			comments[p.ID][j] = c
+		}
+		p.Images = images[p.ID]
+		p.Likes = likes[p.ID]
+		p.Comments = comments[p.ID]
+		p.Tags = e.tags[entityKey{PostID: p.ID}]
+		p.Mentions = e.mentions[entityKey{PostID: p.ID}]
+		posts[i] = p
+	}
+	return posts, nil
+}
+
+// expireExports deletes the exports completed for longer than the retention
+// period, and their archives.
+func (s *service) expireExports(ctx context.Context) (int, error) {
+	exportIDs, err := s.store.ExpiredExports(ctx, time.Now().Add(-s.exportRetention))
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range exportIDs {
+		err = os.Remove(s.exportPath(id))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return i, wrap(err, "removing archive of export %d", id)
+		}
+
+		err = s.store.DeleteExport(ctx, id)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(exportIDs), nil
+}
+
+// runExportExpiry deletes the expired exports periodically, until the context
+// is closed.
+func (s *service) runExportExpiry(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		ctx, span := s.tracer.Start(ctx, "expire exports")
+		n, err := s.expireExports(ctx)
+		if err != nil {
+			s.log(ctx).Error("expiring exports", "err", err)
+		}
+		if n != 0 {
+			s.log(ctx).Info("expired exports", "count", n)
+		}
+		endSpan(span, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// addExportFile copies a file in the archive under the given name.
+func addExportFile(zw *zip.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return wrap(err, "opening %s", name)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return wrap(err, "reading %s", name)
+	}
+
+	// Images are already compressed, there is nothing to gain compressing
+	// them again.
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: info.ModTime(),
+	})
+	if err != nil {
+		return wrap(err, "creating %s", name)
+	}
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		return wrap(err, "writing %s", name)
+	}
+	return nil
+}
+
+// takeoutIndex is the HTML page of the exports, to browse the data without
+// reading the manifest.
+var takeoutIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Phototrail export of {{ .Profile.Name }}</title>
+	<style>
+		body { font-family: sans-serif; max-width: 48em; margin: auto; }
+		article { border-bottom: 1px solid #ccc; padding: 1em 0; }
+		img { max-width: 100%; }
+		time { color: #666; }
+	</style>
+</head>
+<body>
+	<h1>{{ .Profile.Name }}</h1>
+	<p>Exported on <time>{{ .ExportedAt.Format "2006-01-02 15:04:05 MST" }}</time>.</p>
+
+	<h2>Posts</h2>
+	{{ range .Posts }}
+	<article id="post-{{ .ID }}">
+		<time>{{ .CreatedAt.Format "2006-01-02 15:04:05 MST" }}</time>
+		{{ if .Place }}<p>{{ .Place }}</p>{{ end }}
+		<p>{{ .Text }}</p>
+		{{ range .Images }}<img src="{{ . }}">{{ end }}
+		{{ if .Likes }}<p>Liked by {{ range $i, $l := .Likes }}{{ if $i }}, {{ end }}{{ $l.UserName }}{{ end }}</p>{{ end }}
+		{{ range .Comments }}
+		<blockquote><strong>{{ .UserName }}</strong>: {{ .Text }} <time>{{ .CreatedAt.Format "2006-01-02 15:04:05 MST" }}</time></blockquote>
+		{{ end }}
+	</article>
+	{{ else }}
+	<p>No posts.</p>
+	{{ end }}
+
+	<h2>Comments</h2>
+	<ul>
+	{{ range .Comments }}
+		<li><time>{{ .CreatedAt.Format "2006-01-02 15:04:05 MST" }}</time> on post {{ .PostID }}: {{ .Text }}</li>
+	{{ else }}
+		<li>No comments.</li>
+	{{ end }}
+	</ul>
+
+	<h2>Likes</h2>
+	<ul>
+	{{ range .Likes }}
+		<li>Post {{ .PostID }} of {{ .UserName }}</li>
+	{{ else }}
+		<li>No likes.</li>
+	{{ end }}
+	</ul>
+</body>
+</html>
+`))
+
+func (s *service) createExport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permExport, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	// Only one export is built at a time for a user, asking for another one
+	// returns the pending one.
+	e, created, err := s.store.CreateExport(r.Context(), u.ID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !created {
+		write(w, http.StatusAccepted, e)
+		return
+	}
+
+	// The export outlives the request, so it can't use its context.
+	go s.runExport(context.Background(), e.ID, u.ID)
+
+	write(w, http.StatusAccepted, e)
+}
+
+func (s *service) getExport(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permExport, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	exportID, err := strconv.ParseInt(p.ByName("export_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("export_id", err))
+		return
+	}
+
+	e, err := s.store.Export(r.Context(), u.ID, exportID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.writeError(w, r, http.StatusNotFound, &apiError{status: http.StatusNotFound, code: "export_not_found", message: "export not found"})
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Until the archive is ready, the status of the export is returned
+	// instead.
+	switch e.Status {
+	case exportPending:
+		write(w, http.StatusAccepted, e)
+		return
+	case exportFailed:
+		write(w, http.StatusOK, e)
+		return
+	}
+
+	file, err := os.Open(s.exportPath(e.ID))
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "opening export"))
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="phototrail-export-%d.zip"`, e.ID))
+	http.ServeContent(w, r, "", *e.CompletedAt, file)
+}
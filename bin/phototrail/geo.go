@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// checkLocation ensures the coordinates of a post are either both absent or
+// both present and valid.
+func checkLocation(latitude, longitude *float64) error {
+	if latitude == nil && longitude == nil {
+		return nil
+	}
+	if latitude == nil || longitude == nil {
+		return invalidField("location", "incomplete", "latitude and longitude must be provided together")
+	}
+	if *latitude < -90 || *latitude > 90 {
+		return invalidField("latitude", "out_of_range", fmt.Sprintf("invalid latitude %v", *latitude))
+	}
+	if *longitude < -180 || *longitude > 180 {
+		return invalidField("longitude", "out_of_range", fmt.Sprintf("invalid longitude %v", *longitude))
+	}
+	return nil
+}
+
+// geotagPost sets the location of a post from the GPS coordinates in the EXIF
+// data of one of its images. Posts that already have a location are left
+// untouched, as well as images without coordinates.
+func (s *service) geotagPost(ctx context.Context, postID int64, raw []byte) error {
+	ctx, span := s.tracer.Start(ctx, "geotag")
+	defer span.End()
+
+	x, err := exif.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+
+	latitude, longitude, err := x.LatLong()
+	if err != nil {
+		return nil
+	}
+
+	err = checkLocation(&latitude, &longitude)
+	if err != nil {
+		return wrap(err, "reading coordinates")
+	}
+
+	_, err = s.database.ExecContext(ctx, `
+		update posts
+		set latitude = ?, longitude = ?
+		where id = ?
+		and latitude is null
+	`, latitude, longitude, postID)
+	if err != nil {
+		return wrap(err, "updating post location")
+	}
+
+	return nil
+}
+
+// bbox is a bounding box, in the GeoJSON order.
+type bbox struct {
+	MinLongitude float64
+	MinLatitude  float64
+	MaxLongitude float64
+	MaxLatitude  float64
+}
+
+// parseBBox reads a bounding box formatted as
+// "min_longitude,min_latitude,max_longitude,max_latitude". A box crossing the
+// antimeridian has its minimum longitude greater than its maximum.
+func parseBBox(raw string) (bbox, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return bbox{}, errors.New("expected 4 coordinates")
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox{}, wrap(err, "parsing coordinate %d", i)
+		}
+		values[i] = v
+	}
+
+	b := bbox{
+		MinLongitude: values[0],
+		MinLatitude:  values[1],
+		MaxLongitude: values[2],
+		MaxLatitude:  values[3],
+	}
+
+	err := checkLocation(&b.MinLatitude, &b.MinLongitude)
+	if err != nil {
+		return bbox{}, err
+	}
+	err = checkLocation(&b.MaxLatitude, &b.MaxLongitude)
+	if err != nil {
+		return bbox{}, err
+	}
+	if b.MinLatitude > b.MaxLatitude {
+		return bbox{}, errors.New("minimum latitude greater than maximum latitude")
+	}
+
+	return b, nil
+}
+
+func (s *service) nearPosts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	_, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	b, err := parseBBox(r.URL.Query().Get("bbox"))
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("bbox", err))
+		return
+	}
+
+	pg, err := s.parsePage(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// A box crossing the antimeridian is made of the two boxes on each side
+	// of it.
+	operator := "and"
+	if b.MinLongitude > b.MaxLongitude {
+		operator = "or"
+	}
+
+	f, err := s.listPosts(r.Context(), pg, fmt.Sprintf(`
+		and latitude between ? and ?
+		and (longitude >= ? %s longitude <= ?)
+	`, operator), b.MinLatitude, b.MaxLatitude, b.MinLongitude, b.MaxLongitude)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "querying posts"))
+		return
+	}
+
+	write(w, http.StatusOK, f)
+}
+
+// GeoJSON types, limited to what's needed to export a trail.
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+type feature struct {
+	Type       string                 `json:"type"`
+	Geometry   geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+func (s *service) trail(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	userID, err := strconv.ParseInt(p.ByName("user_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("user_id", err))
+		return
+	}
+
+	var posts []struct {
+		ID        int       `db:"id"`
+		Text      string    `db:"text"`
+		Place     string    `db:"place"`
+		CreatedAt time.Time `db:"created_at"`
+		Latitude  float64   `db:"latitude"`
+		Longitude float64   `db:"longitude"`
+	}
+	err = s.reader.SelectContext(r.Context(), &posts, fmt.Sprintf(`
+		select id, text, coalesce(place, '') as place, created_at, latitude, longitude
+		from posts
+		where user_id = ?
+		and latitude is not null
+		and hidden_at is null
+		%s
+		order by created_at asc
+	`, s.restrictedFilter("user_id")), userID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "querying trail"))
+		return
+	}
+
+	// The trail is the line going through each located post in
+	// chronological order, followed by a point for each post.
+	c := featureCollection{
+		Type:     "FeatureCollection",
+		Features: []feature{},
+	}
+	var line [][2]float64
+	for _, p := range posts {
+		line = append(line, [2]float64{p.Longitude, p.Latitude})
+	}
+	if len(line) > 1 {
+		c.Features = append(c.Features, feature{
+			Type: "Feature",
+			Geometry: geometry{
+				Type:        "LineString",
+				Coordinates: line,
+			},
+			Properties: map[string]interface{}{
+				"user_id": userID,
+			},
+		})
+	}
+	for _, p := range posts {
+		c.Features = append(c.Features, feature{
+			Type: "Feature",
+			Geometry: geometry{
+				Type:        "Point",
+				Coordinates: [2]float64{p.Longitude, p.Latitude},
+			},
+			Properties: map[string]interface{}{
+				"post_id":    p.ID,
+				"text":       p.Text,
+				"place":      p.Place,
+				"created_at": p.CreatedAt,
+			},
+		})
+	}
+
+	raw, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(raw)
+}
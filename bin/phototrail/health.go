@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// errUnsupported is returned by the checks that can't be done on the current
+// platform. They are reported but don't make the service unready.
+var errUnsupported = errors.New("unsupported on this platform")
+
+// checkTimeout is the time given to each readiness check.
+const checkTimeout = 2 * time.Second
+
+// check is the result of a readiness check. The endpoint is public, so the
+// errors are only logged.
+type check struct {
+	Status string `json:"status"`
+}
+
+// readiness returns the checks of the readiness of the service, by name.
+func (s *service) readiness() map[string]func(ctx context.Context) error {
+	return map[string]func(ctx context.Context) error{
+		"database":          s.checkDatabase,
+		"data_directory":    s.checkDataDir,
+		"disk_space":        s.checkDiskSpace,
+		"identity_provider": s.checkIdentityProvider,
+	}
+}
+
+// checkDatabase probes the readers, as the single connection of the writer
+// would make the probes wait for the writes in progress.
+func (s *service) checkDatabase(ctx context.Context) error {
+	var one int
+	return s.reader.GetContext(ctx, &one, `select 1`)
+}
+
+func (s *service) checkDataDir(ctx context.Context) error {
+	file, err := ioutil.TempFile(s.dataDir, "readyz-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func (s *service) checkDiskSpace(ctx context.Context) error {
+	free, err := freeSpace(s.dataDir)
+	if err != nil {
+		return err
+	}
+	if free < s.minFreeSpace {
+		return fmt.Errorf("%d bytes free, %d required", free, s.minFreeSpace)
+	}
+	return nil
+}
+
+// checkIdentityProvider ensures the identity provider answers. Any answer
+// that isn't a server error is good enough, as the base URL isn't an endpoint
+// of the API.
+func (s *service) checkIdentityProvider(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.authDomain, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (s *service) healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	write(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func (s *service) readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var checks = make(map[string]check)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, fn := range s.readiness() {
+		wg.Add(1)
+		go func(name string, fn func(ctx context.Context) error) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+
+			c := check{Status: "ok"}
+			err := fn(ctx)
+			if errors.Is(err, errUnsupported) {
+				c = check{Status: "skipped"}
+			} else if err != nil {
+				s.log(ctx).Warn("failing readiness check", "check", name, "err", err)
+				c = check{Status: "error"}
+			}
+
+			mutex.Lock()
+			checks[name] = c
+			mutex.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+
+	// The service stops being ready as soon as it starts shutting down, so
+	// the orchestrators stop sending it traffic while the pending requests
+	// are handled.
+	if atomic.LoadInt32(&s.shuttingDown) == 1 {
+		checks["shutdown"] = check{Status: "error"}
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, c := range checks {
+		if c.Status == "error" {
+			status, code = "unready", http.StatusServiceUnavailable
+		}
+	}
+
+	write(w, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/text/unicode/norm"
+)
+
+// errArchiveTooLarge is returned when an archive exceeds the size allowed for
+// the imports.
+var errArchiveTooLarge = &apiError{status: http.StatusRequestEntityTooLarge, code: "archive_too_large", message: "archive too large"}
+
+// invalidArchive is returned when an archive can't be imported. The reason is
+// stable, while the cause, which holds the details of the parsing, is only
+// logged.
+func invalidArchive(reason string, err error) error {
+	return &apiError{status: http.StatusBadRequest, code: "invalid_archive", message: "invalid archive: " + reason, cause: err}
+}
+
+// importError is the error answered when an import stops midway, with the
+// counts of the posts imported and skipped until then.
+type importError struct {
+	Error
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// importItem is a post read from the archive of another service.
+type importItem struct {
+	// ExternalID identifies the post in the archive, so importing the same
+	// archive again doesn't create it twice.
+	ExternalID string
+	Text       string
+	CreatedAt  time.Time
+	Latitude   *float64
+	Longitude  *float64
+	// Media are the paths of the images of the post in the archive.
+	Media []string
+}
+
+// importers are the parsers of the supported archives, by source.
+var importers = map[string]func(zr *zip.Reader) ([]importItem, error){
+	"instagram": parseInstagram,
+	"google":    parseGoogleTakeout,
+}
+
+// maxArchiveJSONSize is the size of the JSON files of the archives above which
+// they are refused, as they are decoded in memory.
+const maxArchiveJSONSize = 64 << 20
+
+// importableMedia are the extensions of the media files that can be imported.
+// Videos are left out, as posts can only hold images.
+var importableMedia = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".heic": true,
+}
+
+// findMedia returns the file of the archive designated by the URI, which can
+// be relative to the root of the export inside the archive.
+func findMedia(zr *zip.Reader, uri string) *zip.File {
+	if !importableMedia[strings.ToLower(path.Ext(uri))] {
+		return nil
+	}
+	for _, f := range zr.File {
+		if f.Name == uri || strings.HasSuffix(f.Name, "/"+uri) {
+			return f
+		}
+	}
+	return nil
+}
+
+// fixInstagramText repairs the text of Instagram's exports, which encode each
+// byte of UTF-8 strings as a separate character.
+func fixInstagramText(s string) string {
+	var raw = make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return s
+		}
+		raw = append(raw, byte(r))
+	}
+	if !utf8.Valid(raw) {
+		return s
+	}
+	return string(raw)
+}
+
+// importText normalises the text of an archive item the way the payloads are,
+// and truncates it to the length allowed for the text of the posts.
+func importText(s string) string {
+	const max = 2000
+
+	s = strings.TrimSpace(norm.NFC.String(s))
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return strings.TrimSpace(string([]rune(s)[:max]))
+}
+
+// instagramPosts matches the files listing the posts in Instagram's exports.
+var instagramPosts = regexp.MustCompile(`(^|/)content/posts_\d+\.json$`)
+
+// parseInstagram reads the posts of an Instagram export, in its JSON format.
+func parseInstagram(zr *zip.Reader) ([]importItem, error) {
+	type media struct {
+		URI               string `json:"uri"`
+		CreationTimestamp int64  `json:"creation_timestamp"`
+		Title             string `json:"title"`
+		MediaMetadata     struct {
+			PhotoMetadata struct {
+				ExifData []struct {
+					Latitude  *float64 `json:"latitude"`
+					Longitude *float64 `json:"longitude"`
+				} `json:"exif_data"`
+			} `json:"photo_metadata"`
+		} `json:"media_metadata"`
+	}
+
+	var items []importItem
+	var found bool
+	for _, f := range zr.File {
+		if !instagramPosts.MatchString(f.Name) {
+			continue
+		}
+		found = true
+
+		var posts []struct {
+			Media             []media `json:"media"`
+			Title             string  `json:"title"`
+			CreationTimestamp int64   `json:"creation_timestamp"`
+		}
+		err := readJSON(f, &posts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range posts {
+			if len(p.Media) == 0 {
+				continue
+			}
+
+			// Posts with a single media have their caption and date on the
+			// media itself.
+			item := importItem{
+				ExternalID: p.Media[0].URI,
+				Text:       fixInstagramText(p.Title),
+				CreatedAt:  time.Unix(p.CreationTimestamp, 0),
+			}
+			if item.Text == "" {
+				item.Text = fixInstagramText(p.Media[0].Title)
+			}
+			if p.CreationTimestamp == 0 {
+				item.CreatedAt = time.Unix(p.Media[0].CreationTimestamp, 0)
+			}
+
+			// The same file can appear several times in a carousel.
+			seen := make(map[string]bool)
+			for _, m := range p.Media {
+				file := findMedia(zr, m.URI)
+				if file == nil || seen[file.Name] {
+					continue
+				}
+				seen[file.Name] = true
+				item.Media = append(item.Media, file.Name)
+
+				for _, exif := range m.MediaMetadata.PhotoMetadata.ExifData {
+					if item.Latitude == nil && checkLocation(exif.Latitude, exif.Longitude) == nil {
+						item.Latitude, item.Longitude = exif.Latitude, exif.Longitude
+					}
+				}
+			}
+
+			items = append(items, item)
+		}
+	}
+
+	if !found {
+		return nil, errors.New("no posts found, is it an Instagram export in JSON format?")
+	}
+	return items, nil
+}
+
+// parseGoogleTakeout reads the photos of a Google Photos export, each photo
+// being described by a JSON file next to it.
+func parseGoogleTakeout(zr *zip.Reader) ([]importItem, error) {
+	var items []importItem
+	var seen = make(map[string]bool)
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, ".json") {
+			continue
+		}
+
+		var metadata struct {
+			Title          string `json:"title"`
+			Description    string `json:"description"`
+			PhotoTakenTime *struct {
+				Timestamp string `json:"timestamp"`
+			} `json:"photoTakenTime"`
+			GeoData struct {
+				Latitude  float64 `json:"latitude"`
+				Longitude float64 `json:"longitude"`
+			} `json:"geoData"`
+		}
+		// The other JSON files of the export describe the albums and other
+		// things that aren't imported.
+		err := readJSON(f, &metadata)
+		if err != nil || metadata.PhotoTakenTime == nil {
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(metadata.PhotoTakenTime.Timestamp, 10, 64)
+		if err != nil {
+			return nil, wrap(err, "parsing timestamp of %s", f.Name)
+		}
+
+		// The same photo appears in the folder of each album it belongs to.
+		externalID := fmt.Sprintf("%d/%s", timestamp, metadata.Title)
+		if seen[externalID] {
+			continue
+		}
+
+		file := findMedia(zr, path.Join(path.Dir(f.Name), metadata.Title))
+		if file == nil {
+			continue
+		}
+		seen[externalID] = true
+
+		item := importItem{
+			ExternalID: externalID,
+			Text:       metadata.Description,
+			CreatedAt:  time.Unix(timestamp, 0),
+			Media:      []string{file.Name},
+		}
+
+		// Photos without location have zero coordinates.
+		latitude, longitude := metadata.GeoData.Latitude, metadata.GeoData.Longitude
+		if (latitude != 0 || longitude != 0) && checkLocation(&latitude, &longitude) == nil {
+			item.Latitude, item.Longitude = &latitude, &longitude
+		}
+
+		items = append(items, item)
+	}
+
+	if len(seen) == 0 {
+		return nil, errors.New("no photos found, is it a Google Photos export?")
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreatedAt.Before(items[j].CreatedAt)
+	})
+	return items, nil
+}
+
+// readJSON decodes a JSON file of an archive.
+func readJSON(f *zip.File, v interface{}) error {
+	raw, err := readFile(f, maxArchiveJSONSize)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(raw, v)
+	if err != nil {
+		return wrap(err, "parsing %s", f.Name)
+	}
+	return nil
+}
+
+// errFileTooLarge is returned when a file of an archive exceeds the size
+// allowed for it.
+var errFileTooLarge = errors.New("file too large")
+
+// readFile reads a file of an archive, up to the limit. The size announced by
+// the archive is checked first, but a crafted archive can lie about it, so the
+// file is still read through the limit.
+func readFile(f *zip.File, limit int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, wrap(errFileTooLarge, "reading %s", f.Name)
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return nil, wrap(err, "opening %s", f.Name)
+	}
+	defer r.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, wrap(err, "reading %s", f.Name)
+	}
+	if int64(len(raw)) > limit {
+		return nil, wrap(errFileTooLarge, "reading %s", f.Name)
+	}
+	return raw, nil
+}
+
+// importArchive creates the posts parsed from an archive for the user,
+// skipping the ones already imported. It returns the number of posts imported
+// and skipped.
+func (s *service) importArchive(ctx context.Context, u user, source string, items []importItem, zr *zip.Reader) (int, int, error) {
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var imported, skipped int
+	for _, item := range items {
+		_, err := s.store.ImportedPost(ctx, u.ID, source, item.ExternalID)
+		if err == nil {
+			skipped++
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return imported, skipped, err
+		}
+
+		if len(item.Media) == 0 {
+			skipped++
+			continue
+		}
+
+		// The images too large to be stored never will be, so their posts
+		// are skipped rather than stopping the import.
+		err = s.importItem(ctx, u, source, item, files)
+		if errors.Is(err, errImageTooLarge) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return imported, skipped, wrap(err, "importing %s", item.ExternalID)
+		}
+		imported++
+	}
+
+	return imported, skipped, nil
+}
+
+// importItem creates the post of an archive item with its images. The post
+// is removed if any of its images can't be imported, so importing the archive
+// again retries it. The mentions of the archive were meant for the users of
+// another service, so nobody is notified of them.
+func (s *service) importItem(ctx context.Context, u user, source string, item importItem, files map[string]*zip.File) error {
+	postID, _, _, err := s.store.CreatePost(ctx, u.ID, post{
+		Text:      importText(item.Text),
+		CreatedAt: item.CreatedAt,
+		Latitude:  item.Latitude,
+		Longitude: item.Longitude,
+	}, false)
+	if err == nil {
+		err = s.importMedia(ctx, u.ID, postID, item.Media, files)
+	}
+	if err == nil {
+		err = s.store.RecordImport(ctx, u.ID, source, item.ExternalID, postID)
+	}
+	if err != nil {
+		if postID != 0 {
+			_ = s.store.DeletePost(ctx, postID)
+		}
+		return err
+	}
+	return nil
+}
+
+// importMedia stores the images of an archive item, within the maximum size
+// of the images and the quota of the user. The images are refused before
+// being decompressed if they can't fit.
+func (s *service) importMedia(ctx context.Context, userID int, postID int64, media []string, files map[string]*zip.File) error {
+	for _, name := range media {
+		limit, tooLarge, err := s.imageLimit(ctx, userID)
+		if err != nil {
+			return err
+		}
+
+		raw, err := readFile(files[name], limit)
+		if errors.Is(err, errFileTooLarge) {
+			return wrap(tooLarge, "reading %s", name)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = s.storeImage(ctx, userID, postID, raw)
+		if err != nil {
+			return wrap(err, "storing %s", name)
+		}
+	}
+	return nil
+}
+
+func (s *service) importPosts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permImport, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	if _, ok := importers[source]; !ok {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("source", fmt.Errorf("unknown source %q", source)))
+		return
+	}
+
+	// Zip archives can't be read from a stream, so the archive is stored
+	// while it's imported.
+	file, err := ioutil.TempFile(s.dataDir, "import-")
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "creating temporary file"))
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// The reader fails once the limit is reached, so an archive read up to
+	// the limit is too large.
+	size, err := io.Copy(file, http.MaxBytesReader(w, r.Body, s.maxImportSize))
+	if err != nil && size == s.maxImportSize {
+		s.writeError(w, r, http.StatusRequestEntityTooLarge, errArchiveTooLarge)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidArchive("can't be read", err))
+		return
+	}
+
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidArchive("not a zip file", err))
+		return
+	}
+
+	items, err := importers[source](zr)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidArchive(fmt.Sprintf("not a %s export", source), err))
+		return
+	}
+
+	// The posts imported before reaching the quota are kept, and importing
+	// the archive again once there is room resumes where it stopped.
+	imported, skipped, err := s.importArchive(r.Context(), u, source, items, zr)
+	if errors.Is(err, errQuotaExceeded) {
+		status, payload := newError(r.Context(), http.StatusRequestEntityTooLarge, err)
+		write(w, status, importError{
+			Error:    payload,
+			Imported: imported,
+			Skipped:  skipped,
+		})
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "importing archive"))
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadFile(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("image.jpg")
+	if err != nil {
+		t.Fatalf("creating file: %s", err)
+	}
+	_, err = w.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatalf("writing file: %s", err)
+	}
+	err = zw.Close()
+	if err != nil {
+		t.Fatalf("closing archive: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		limit int64
+		// announced overrides the size announced by the archive.
+		announced uint64
+		err       bool
+		tooLarge  bool
+	}{
+		{name: "within the limit", limit: 1000},
+		{name: "announced above the limit", limit: 999, err: true, tooLarge: true},
+		{name: "announced below its size", limit: 999, announced: 10, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("opening archive: %s", err)
+			}
+			f := zr.File[0]
+			if tc.announced != 0 {
+				f.UncompressedSize64 = tc.announced
+			}
+
+			raw, err := readFile(f, tc.limit)
+			if tc.err != (err != nil) {
+				t.Fatalf("got error %v, expected an error: %t", err, tc.err)
+			}
+			if tc.tooLarge != errors.Is(err, errFileTooLarge) {
+				t.Errorf("got error %v, expected errFileTooLarge: %t", err, tc.tooLarge)
+			}
+			if !tc.err && len(raw) != 1000 {
+				t.Errorf("read %d bytes, expected 1000", len(raw))
+			}
+		})
+	}
+}
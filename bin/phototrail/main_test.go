@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/patrickmn/go-cache"
+	"go4.org/syncutil/singleflight"
+)
+
+// newTestService returns a service initialized as init does, without the
+// logs, on a migrated SQLite database in a temporary data directory.
+func newTestService(t testing.TB) *service {
+	t.Helper()
+	return newTestServiceOn(t, "")
+}
+
+// newTestServiceOn returns a test service on the PostgreSQL database of the
+// URL, or on SQLite if the URL is empty. The PostgreSQL database is emptied
+// first, so it must be dedicated to the tests.
+func newTestServiceOn(t testing.TB, databaseURL string) *service {
+	t.Helper()
+
+	s := &service{
+		dataDir:         t.TempDir(),
+		databaseURL:     databaseURL,
+		databaseReaders: 4,
+		maxPageSize:     100,
+	}
+	s.logger = log15.New()
+	s.logger.SetHandler(log15.DiscardHandler())
+	s.metrics = s.newMetrics()
+
+	err := s.initTracing(context.Background())
+	if err != nil {
+		t.Fatalf("initializing tracing: %s", err)
+	}
+
+	if databaseURL != "" {
+		err = s.connectPostgres()
+	} else {
+		err = s.connectSQLite()
+	}
+	if err != nil {
+		t.Fatalf("connecting to the database: %s", err)
+	}
+	t.Cleanup(func() {
+		s.reader.Close()
+		s.database.Close()
+	})
+
+	if s.isPostgres() {
+		_, err = s.database.Exec(`drop schema public cascade; create schema public`)
+		if err != nil {
+			t.Fatalf("emptying database: %s", err)
+		}
+	}
+
+	_, err = s.migrate(context.Background())
+	if err != nil {
+		t.Fatalf("migrating database: %s", err)
+	}
+
+	s.group = new(singleflight.Group)
+	s.cache = cache.New(time.Minute, 2*time.Minute)
+	s.limiters = cache.New(cache.NoExpiration, 5*time.Minute)
+	s.pages = cache.New(s.pageCacheTTL, time.Minute)
+	return s
+}
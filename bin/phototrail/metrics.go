@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/negroni"
+)
+
+// metrics holds the Prometheus metrics of the service.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	authCache        *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	queryDuration    *prometheus.HistogramVec
+	uploadSize       prometheus.Histogram
+	storage          *prometheus.GaugeVec
+	rateLimited      *prometheus.CounterVec
+	pageCache        *prometheus.CounterVec
+}
+
+// newMetrics creates and registers the metrics of the service.
+func (s *service) newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phototrail_http_requests_total",
+			Help: "Number of HTTP requests handled, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "phototrail_http_request_duration_seconds",
+			Help:    "Duration of the HTTP requests, by route, method and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		authCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phototrail_auth_cache_lookups_total",
+			Help: "Number of lookups of the authentication cache, by result (hit or miss).",
+		}, []string{"result"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "phototrail_auth_upstream_duration_seconds",
+			Help:    "Duration of the requests to the identity provider, by endpoint.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "phototrail_database_query_duration_seconds",
+			Help:    "Duration of the database statements, by operation and outcome.",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, []string{"operation", "outcome"}),
+		uploadSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "phototrail_upload_size_bytes",
+			Help:    "Size of the uploaded images.",
+			Buckets: prometheus.ExponentialBuckets(16*1024, 4, 8),
+		}),
+		storage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "phototrail_storage_bytes",
+			Help: "Size of the data stored, by kind (database or images).",
+		}, []string{"kind"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phototrail_rate_limited_requests_total",
+			Help: "Number of requests rejected by the rate limits, by class.",
+		}, []string{"class"}),
+		pageCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "phototrail_page_cache_lookups_total",
+			Help: "Number of lookups of the page cache, by result (hit or miss).",
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.authCache,
+		m.upstreamDuration,
+		m.queryDuration,
+		m.uploadSize,
+		m.storage,
+		m.rateLimited,
+		m.pageCache,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "phototrail_auth_cache_entries",
+			Help: "Number of authentications in the cache.",
+		}, func() float64 {
+			return float64(s.cache.ItemCount())
+		}),
+	)
+
+	return m
+}
+
+// observeQuery records the duration of a database statement.
+func (m *metrics) observeQuery(query string, duration time.Duration, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	m.queryDuration.WithLabelValues(queryOperation(query), outcome).Observe(duration.Seconds())
+}
+
+// observeUpstream records the duration of a request to the identity provider.
+func (m *metrics) observeUpstream(endpoint string, start time.Time) {
+	m.upstreamDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
+
+// measureRequest is a middleware recording the metrics of the requests
+// handled by the router. Requests are labelled by route rather than path, so
+// the number of series stays bounded.
+func (s *service) measureRequest(router *httprouter.Router) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+
+		// The file servers modify the path of the request, so it must be read
+		// beforehand.
+		path := r.URL.Path
+
+		next(rw, r)
+
+		route := "unmatched"
+		if h, params, _ := router.Lookup(r.Method, path); h != nil {
+			route = routePattern(path, params)
+		}
+
+		status := strconv.Itoa(rw.(negroni.ResponseWriter).Status())
+		s.metrics.requests.WithLabelValues(route, r.Method, status).Inc()
+		s.metrics.requestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// routePattern rebuilds the pattern of the route matching the path, by
+// replacing the values of the parameters by their names.
+func routePattern(path string, params httprouter.Params) string {
+	segments := strings.Split(path, "/")
+	var i int
+	for _, p := range params {
+		// Catch-all parameters match the end of the path, including the
+		// slashes.
+		if strings.HasPrefix(p.Value, "/") {
+			return strings.TrimSuffix(path, p.Value) + "/*" + p.Key
+		}
+		for ; i < len(segments); i++ {
+			if segments[i] == p.Value {
+				segments[i] = ":" + p.Key
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// measureStorage updates the storage metrics periodically, until the context
+// is closed. Walking the images directory is too slow to be done on each
+// scrape.
+func (s *service) measureStorage(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		info, err := os.Stat(filepath.Join(s.dataDir, "database.sqlite"))
+		if err == nil {
+			s.metrics.storage.WithLabelValues("database").Set(float64(info.Size()))
+		}
+
+		var size int64
+		err = filepath.Walk(filepath.Join(s.dataDir, "images"), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Error("measuring images size", "err", err)
+		} else {
+			s.metrics.storage.WithLabelValues("images").Set(float64(size))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus format.
+func (s *service) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// runAdmin serves the metrics and the health checks on the admin address
+// until the context is closed.
+func (s *service) runAdmin(ctx context.Context) {
+	router := httprouter.New()
+	router.Handler(http.MethodGet, "/metrics", s.metricsHandler())
+	router.GET("/healthz", s.healthz)
+	router.GET("/readyz", s.readyz)
+
+	s.logger.Debug("starting admin server")
+	server := &http.Server{
+		Addr:    s.adminBind,
+		Handler: router,
+	}
+	go func() {
+		<-ctx.Done()
+		err := server.Close()
+		if err != nil {
+			s.logger.Error("closing admin server", "err", err)
+		}
+	}()
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("closing admin server", "err", err)
+	}
+}
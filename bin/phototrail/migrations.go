@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// migrations is the list of the changes to apply to the database schema, in
+// order. The schema version of a database is the number of migrations applied
+// to it, stored in its user_version. Migrations must never be modified once
+// released, only appended to.
+var migrations = []string{
+	// 1: the initial schema. Tables are only created if they don't exist, as
+	// the databases created before the migrations were introduced have them
+	// already.
+	`
+	create table if not exists users (
+		id integer,
+		sub varchar(255) not null,
+		name varchar(255) not null,
+
+		primary key (id),
+		unique (sub)
+	);
+
+	create table if not exists posts (
+		id integer,
+		user_id integer not null,
+		text text,
+		created_at datetime default current_timestamp,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table if not exists images (
+		post_id integer,
+		path varchar(255),
+
+		primary key (post_id, path),
+		foreign key (post_id) references posts(id) on delete cascade
+	);
+
+	create table if not exists likes (
+		post_id integer,
+		user_id integer,
+
+		primary key (post_id, user_id),
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table if not exists comments (
+		id integer,
+		post_id integer,
+		user_id integer,
+		text text,
+		created_at datetime default current_timestamp,
+
+		primary key (id),
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+	`,
+	// 2: tags, mentions and notifications.
+	`
+	create table tags (
+		post_id integer not null,
+		comment_id integer,
+		tag varchar(255) not null,
+
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (comment_id) references comments(id) on delete cascade
+	);
+
+	create index tags_tag on tags (tag);
+	create index tags_post_id on tags (post_id);
+
+	create table mentions (
+		post_id integer not null,
+		comment_id integer,
+		user_id integer not null,
+
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (comment_id) references comments(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create index mentions_post_id on mentions (post_id);
+
+	create table notifications (
+		id integer,
+		user_id integer not null,
+		actor_id integer not null,
+		kind varchar(32) not null,
+		post_id integer,
+		comment_id integer,
+		created_at datetime default current_timestamp,
+		read_at datetime,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade,
+		foreign key (actor_id) references users(id) on delete cascade,
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (comment_id) references comments(id) on delete cascade
+	);
+
+	create index notifications_user_id on notifications (user_id, created_at);
+	`,
+	// 3: albums.
+	`
+	create table albums (
+		id integer,
+		user_id integer not null,
+		title varchar(255) not null,
+		description text not null default '',
+		cover varchar(255),
+		created_at datetime default current_timestamp,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table album_posts (
+		album_id integer,
+		post_id integer,
+
+		primary key (album_id, post_id),
+		foreign key (album_id) references albums(id) on delete cascade,
+		foreign key (post_id) references posts(id) on delete cascade
+	);
+
+	create table album_collaborators (
+		album_id integer,
+		user_id integer,
+
+		primary key (album_id, user_id),
+		foreign key (album_id) references albums(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+	`,
+	// 4: location of the posts.
+	`
+	alter table posts add column latitude real;
+	alter table posts add column longitude real;
+	alter table posts add column place varchar(255);
+
+	create index posts_location on posts (latitude, longitude);
+	`,
+	// 5: reports and moderation.
+	`
+	alter table posts add column hidden_at datetime;
+	alter table comments add column hidden_at datetime;
+
+	create table reports (
+		id integer,
+		reporter_id integer not null,
+		target_type varchar(32) not null,
+		target_id integer not null,
+		reason text not null,
+		status varchar(32) not null default 'open',
+		created_at datetime default current_timestamp,
+		resolved_by integer,
+		resolved_at datetime,
+
+		primary key (id),
+		foreign key (reporter_id) references users(id) on delete cascade,
+		foreign key (resolved_by) references users(id) on delete set null
+	);
+
+	create index reports_status on reports (status, created_at);
+	create index reports_target on reports (target_type, target_id);
+
+	create table moderation_log (
+		id integer,
+		moderator_id integer,
+		report_id integer,
+		action varchar(32) not null,
+		target_type varchar(32) not null,
+		target_id integer not null,
+		note text not null default '',
+		created_at datetime default current_timestamp,
+
+		primary key (id),
+		foreign key (moderator_id) references users(id) on delete set null,
+		foreign key (report_id) references reports(id) on delete set null
+	);
+	`,
+	// 6: roles of the users.
+	`
+	alter table users add column role varchar(32) not null default 'user';
+	`,
+	// 7: banning of the users.
+	`
+	alter table users add column banned_at datetime;
+	alter table users add column ban_reason text;
+	`,
+	// 8: suspension of the users.
+	`
+	alter table users add column suspended_until datetime;
+	`,
+	// 9: personal data exports.
+	`
+	create table exports (
+		id integer,
+		user_id integer not null,
+		status varchar(32) not null default 'pending',
+		error text not null default '',
+		created_at datetime default current_timestamp,
+		completed_at datetime,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade
+	);
+	`,
+	// 10: account deletions.
+	`
+	alter table users add column deletion_scheduled_at datetime;
+	alter table users add column deletion_mode varchar(32);
+
+	create index users_deletion_scheduled_at on users (deletion_scheduled_at);
+	`,
+	// 11: imports from other services.
+	`
+	create table imports (
+		user_id integer not null,
+		source varchar(32) not null,
+		external_id varchar(255) not null,
+		post_id integer not null,
+		created_at datetime default current_timestamp,
+
+		primary key (user_id, source, external_id),
+		foreign key (user_id) references users(id) on delete cascade,
+		foreign key (post_id) references posts(id) on delete cascade
+	);
+	`,
+	// 12: storage quotas. The size of the existing images is unknown until
+	// the usage is recomputed.
+	`
+	alter table images add column size integer not null default 0;
+	alter table users add column storage_quota integer;
+	`,
+	// 13: listing of the albums of a user.
+	`
+	create index albums_user_id on albums (user_id, created_at);
+	create index album_collaborators_user_id on album_collaborators (user_id);
+	`,
+	// 14: version of the content, bumped by the writes of the posts, images,
+	// likes, comments and users, whichever process makes them. It starts
+	// from the current time, so the validators given for another database
+	// aren't mistaken for its own.
+	`
+	create table content_version (
+		version integer not null
+	);
+	insert into content_version (version) values (cast(strftime('%s', 'now') as integer));
+
+	create trigger posts_insert_content after insert on posts begin
+		update content_version set version = version + 1;
+	end;
+	create trigger posts_update_content after update on posts begin
+		update content_version set version = version + 1;
+	end;
+	create trigger posts_delete_content after delete on posts begin
+		update content_version set version = version + 1;
+	end;
+	create trigger images_insert_content after insert on images begin
+		update content_version set version = version + 1;
+	end;
+	create trigger images_delete_content after delete on images begin
+		update content_version set version = version + 1;
+	end;
+	create trigger likes_insert_content after insert on likes begin
+		update content_version set version = version + 1;
+	end;
+	create trigger likes_delete_content after delete on likes begin
+		update content_version set version = version + 1;
+	end;
+	create trigger comments_insert_content after insert on comments begin
+		update content_version set version = version + 1;
+	end;
+	create trigger comments_update_content after update on comments begin
+		update content_version set version = version + 1;
+	end;
+	create trigger comments_delete_content after delete on comments begin
+		update content_version set version = version + 1;
+	end;
+	create trigger users_update_content after update of name, banned_at, suspended_until on users begin
+		update content_version set version = version + 1;
+	end;
+	create trigger users_delete_content after delete on users begin
+		update content_version set version = version + 1;
+	end;
+	`,
+}
+
+// postgresMigrations is the list of the changes to apply to the schema of the
+// PostgreSQL databases, in order, with the same rules. The schema version is
+// stored in the schema_version table. The tags and mentions have an explicit
+// rowid, as they are listed in insertion order.
+var postgresMigrations = []string{
+	// 1: the schema of the 12 first SQLite migrations.
+	`
+	create table users (
+		id bigserial,
+		sub varchar(255) not null,
+		name varchar(255) not null,
+		role varchar(32) not null default 'user',
+		banned_at timestamp,
+		ban_reason text,
+		suspended_until timestamp,
+		deletion_scheduled_at timestamp,
+		deletion_mode varchar(32),
+		storage_quota bigint,
+
+		primary key (id),
+		unique (sub)
+	);
+
+	create index users_deletion_scheduled_at on users (deletion_scheduled_at);
+
+	create table posts (
+		id bigserial,
+		user_id bigint not null,
+		text text,
+		created_at timestamp default current_timestamp,
+		latitude double precision,
+		longitude double precision,
+		place varchar(255),
+		hidden_at timestamp,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create index posts_location on posts (latitude, longitude);
+
+	create table images (
+		post_id bigint,
+		path varchar(255),
+		size bigint not null default 0,
+
+		primary key (post_id, path),
+		foreign key (post_id) references posts(id) on delete cascade
+	);
+
+	create table likes (
+		post_id bigint,
+		user_id bigint,
+
+		primary key (post_id, user_id),
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table comments (
+		id bigserial,
+		post_id bigint,
+		user_id bigint,
+		text text,
+		created_at timestamp default current_timestamp,
+		hidden_at timestamp,
+
+		primary key (id),
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table tags (
+		rowid bigserial,
+		post_id bigint not null,
+		comment_id bigint,
+		tag varchar(255) not null,
+
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (comment_id) references comments(id) on delete cascade
+	);
+
+	create index tags_tag on tags (tag);
+	create index tags_post_id on tags (post_id);
+
+	create table mentions (
+		rowid bigserial,
+		post_id bigint not null,
+		comment_id bigint,
+		user_id bigint not null,
+
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (comment_id) references comments(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create index mentions_post_id on mentions (post_id);
+
+	create table notifications (
+		id bigserial,
+		user_id bigint not null,
+		actor_id bigint not null,
+		kind varchar(32) not null,
+		post_id bigint,
+		comment_id bigint,
+		created_at timestamp default current_timestamp,
+		read_at timestamp,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade,
+		foreign key (actor_id) references users(id) on delete cascade,
+		foreign key (post_id) references posts(id) on delete cascade,
+		foreign key (comment_id) references comments(id) on delete cascade
+	);
+
+	create index notifications_user_id on notifications (user_id, created_at);
+
+	create table albums (
+		id bigserial,
+		user_id bigint not null,
+		title varchar(255) not null,
+		description text not null default '',
+		cover varchar(255),
+		created_at timestamp default current_timestamp,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table album_posts (
+		album_id bigint,
+		post_id bigint,
+
+		primary key (album_id, post_id),
+		foreign key (album_id) references albums(id) on delete cascade,
+		foreign key (post_id) references posts(id) on delete cascade
+	);
+
+	create table album_collaborators (
+		album_id bigint,
+		user_id bigint,
+
+		primary key (album_id, user_id),
+		foreign key (album_id) references albums(id) on delete cascade,
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table reports (
+		id bigserial,
+		reporter_id bigint not null,
+		target_type varchar(32) not null,
+		target_id bigint not null,
+		reason text not null,
+		status varchar(32) not null default 'open',
+		created_at timestamp default current_timestamp,
+		resolved_by bigint,
+		resolved_at timestamp,
+
+		primary key (id),
+		foreign key (reporter_id) references users(id) on delete cascade,
+		foreign key (resolved_by) references users(id) on delete set null
+	);
+
+	create index reports_status on reports (status, created_at);
+	create index reports_target on reports (target_type, target_id);
+
+	create table moderation_log (
+		id bigserial,
+		moderator_id bigint,
+		report_id bigint,
+		action varchar(32) not null,
+		target_type varchar(32) not null,
+		target_id bigint not null,
+		note text not null default '',
+		created_at timestamp default current_timestamp,
+
+		primary key (id),
+		foreign key (moderator_id) references users(id) on delete set null,
+		foreign key (report_id) references reports(id) on delete set null
+	);
+
+	create table exports (
+		id bigserial,
+		user_id bigint not null,
+		status varchar(32) not null default 'pending',
+		error text not null default '',
+		created_at timestamp default current_timestamp,
+		completed_at timestamp,
+
+		primary key (id),
+		foreign key (user_id) references users(id) on delete cascade
+	);
+
+	create table imports (
+		user_id bigint not null,
+		source varchar(32) not null,
+		external_id varchar(255) not null,
+		post_id bigint not null,
+		created_at timestamp default current_timestamp,
+
+		primary key (user_id, source, external_id),
+		foreign key (user_id) references users(id) on delete cascade,
+		foreign key (post_id) references posts(id) on delete cascade
+	);
+	`,
+	// 2: listing of the albums of a user.
+	`
+	create index albums_user_id on albums (user_id, created_at);
+	create index album_collaborators_user_id on album_collaborators (user_id);
+	`,
+	// 3: version of the content. The triggers are per statement, so a write
+	// bumps it once whatever the number of rows.
+	`
+	create table content_version (
+		version bigint not null
+	);
+	insert into content_version (version) values (extract(epoch from now())::bigint);
+
+	create function bump_content_version() returns trigger as $$
+	begin
+		update content_version set version = version + 1;
+		return null;
+	end;
+	$$ language plpgsql;
+
+	create trigger posts_content after insert or update or delete on posts
+		for each statement execute procedure bump_content_version();
+	create trigger images_content after insert or delete on images
+		for each statement execute procedure bump_content_version();
+	create trigger likes_content after insert or delete on likes
+		for each statement execute procedure bump_content_version();
+	create trigger comments_content after insert or update or delete on comments
+		for each statement execute procedure bump_content_version();
+	create trigger users_content after update of name, banned_at, suspended_until or delete on users
+		for each statement execute procedure bump_content_version();
+	`,
+}
+
+// isPostgres checks if the database is a PostgreSQL one.
+func (s *service) isPostgres() bool {
+	return s.database.DriverName() == "postgres"
+}
+
+// migrations returns the migrations of the database.
+func (s *service) migrations() []string {
+	if s.isPostgres() {
+		return postgresMigrations
+	}
+	return migrations
+}
+
+// schemaVersion returns the number of migrations applied to the database.
+func (s *service) schemaVersion(ctx context.Context) (int, error) {
+	var version int
+	var err error
+	if s.isPostgres() {
+		err = s.database.GetContext(ctx, &version, `select coalesce(max(version), 0) from schema_version`)
+
+		// The table is created by the first migration.
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+			return 0, nil
+		}
+	} else {
+		err = s.database.GetContext(ctx, &version, `PRAGMA user_version`)
+	}
+	if err != nil {
+		return 0, wrap(err, "querying schema version")
+	}
+	return version, nil
+}
+
+// migrate applies the pending migrations to the database, each in its own
+// transaction, and returns the resulting schema version.
+func (s *service) migrate(ctx context.Context) (int, error) {
+	version, err := s.schemaVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrations := s.migrations()
+	if version > len(migrations) {
+		return version, fmt.Errorf("database schema version %d is more recent than this binary's %d", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		s.logger.Info("applying migration", "version", version+1)
+
+		tx, err := s.database.BeginTxx(ctx, nil)
+		if err != nil {
+			return version, wrap(err, "starting transaction")
+		}
+
+		_, err = tx.ExecContext(ctx, migrations[version])
+		if err != nil {
+			tx.Rollback()
+			return version, wrap(err, "applying migration %d", version+1)
+		}
+
+		err = s.setSchemaVersion(ctx, tx, version+1)
+		if err != nil {
+			tx.Rollback()
+			return version, wrap(err, "updating schema version")
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return version, wrap(err, "committing migration %d", version+1)
+		}
+	}
+
+	return version, nil
+}
+
+// setSchemaVersion records the schema version of the database in the
+// transaction of a migration.
+func (s *service) setSchemaVersion(ctx context.Context, tx *sqlx.Tx, version int) error {
+	if !s.isPostgres() {
+		// Pragmas don't accept parameters.
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, version))
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		create table if not exists schema_version (
+			version integer not null
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `delete from schema_version`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `insert into schema_version (version) values (?)`, version)
+	return err
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Moderation actions available when resolving a report.
+const (
+	actionHide    = "hide"
+	actionDelete  = "delete"
+	actionDismiss = "dismiss"
+)
+
+// Types of content that can be reported.
+const (
+	targetPost    = "post"
+	targetComment = "comment"
+	targetUser    = "user"
+)
+
+type report struct {
+	ID         int        `json:"id"                    db:"id"`
+	ReporterID int        `json:"reporter_id"           db:"reporter_id"`
+	TargetType string     `json:"target_type"           db:"target_type"`
+	TargetID   int        `json:"target_id"             db:"target_id"`
+	Reason     string     `json:"reason"                db:"reason" validate:"trim,required,max=1000"`
+	Status     string     `json:"status"                db:"status"`
+	CreatedAt  time.Time  `json:"created_at"            db:"created_at"`
+	ResolvedBy *int       `json:"resolved_by,omitempty" db:"resolved_by"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+	PostID     int64      `json:"post_id,omitempty"     db:"-"`
+	CommentID  int64      `json:"comment_id,omitempty"  db:"-"`
+	UserID     int64      `json:"user_id,omitempty"     db:"-"`
+}
+
+type moderationEntry struct {
+	ID          int       `json:"id"           db:"id"`
+	ModeratorID *int      `json:"moderator_id" db:"moderator_id"`
+	ReportID    *int      `json:"report_id"    db:"report_id"`
+	Action      string    `json:"action"       db:"action"`
+	TargetType  string    `json:"target_type"  db:"target_type"`
+	TargetID    int       `json:"target_id"    db:"target_id"`
+	Note        string    `json:"note"         db:"note"`
+	CreatedAt   time.Time `json:"created_at"   db:"created_at"`
+}
+
+// targetTables maps the reportable content types to their table.
+var targetTables = map[string]string{
+	targetPost:    "posts",
+	targetComment: "comments",
+	targetUser:    "users",
+}
+
+func (s *service) createReport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permReport, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	var rep report
+	err = decodePayload(r, &rep)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Exactly one of the targets must be provided.
+	var targets int
+	for typ, id := range map[string]int64{
+		targetPost:    rep.PostID,
+		targetComment: rep.CommentID,
+		targetUser:    rep.UserID,
+	} {
+		if id == 0 {
+			continue
+		}
+		targets++
+		rep.TargetType = typ
+		rep.TargetID = int(id)
+	}
+	if targets != 1 {
+		s.writeError(w, r, http.StatusBadRequest, errors.New("expected exactly one of post_id, comment_id or user_id"))
+		return
+	}
+
+	exists, err := s.store.TargetExists(r.Context(), rep.TargetType, rep.TargetID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		s.writeError(w, r, http.StatusNotFound, &apiError{status: http.StatusNotFound, code: rep.TargetType + "_not_found", message: rep.TargetType + " not found"})
+		return
+	}
+
+	rep.ReporterID = u.ID
+	reportID, err := s.store.CreateReport(r.Context(), rep)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "report_id": reportID})
+}
+
+func (s *service) listReports(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permModerate, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+
+	from, limit, err := s.parsePagination(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	reports, err := s.store.Reports(r.Context(), status, from, limit)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{
+		"reports": reports,
+	})
+}
+
+func (s *service) resolveReport(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permModerate, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	reportID, err := strconv.ParseInt(p.ByName("report_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("report_id", err))
+		return
+	}
+
+	var payload struct {
+		Action string `json:"action"`
+		Note   string `json:"note"   validate:"trim,max=1000"`
+	}
+	err = decodePayload(r, &payload)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	switch payload.Action {
+	case actionHide, actionDelete, actionDismiss:
+	default:
+		s.writeError(w, r, http.StatusBadRequest, invalidField("action", "invalid", fmt.Sprintf("unknown action %q", payload.Action)))
+		return
+	}
+
+	rep, err := s.store.Report(r.Context(), reportID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.writeError(w, r, http.StatusNotFound, &apiError{status: http.StatusNotFound, code: "report_not_found", message: "report not found"})
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if rep.Status != "open" {
+		s.writeError(w, r, http.StatusConflict, &apiError{status: http.StatusConflict, code: "report_already_resolved", message: "report already resolved"})
+		return
+	}
+
+	// Deleting a user removes their files and cached authentications too, so
+	// it goes through the deletion of the accounts, and is reserved to the
+	// admins on the users of a lower role. The user is already gone if a
+	// previous resolution failed after deleting it.
+	if payload.Action == actionDelete && rep.TargetType == targetUser {
+		role, err := s.store.UserRole(r.Context(), rep.TargetID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			s.writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		err = authorize(u, permBanUser, subject{UserID: rep.TargetID, UserRole: role})
+		if err != nil {
+			s.writeError(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		if role != "" {
+			err = s.deleteAccount(r.Context(), rep.TargetID, deletionErase)
+			if err != nil {
+				s.writeError(w, r, http.StatusInternalServerError, wrap(err, "deleting user"))
+				return
+			}
+		}
+	}
+
+	// Every open report about the same content is settled by the same
+	// action.
+	err = s.store.ResolveReport(r.Context(), u.ID, rep, payload.Action, payload.Note)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (s *service) moderationLog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	err = authorize(u, permModerate, subject{})
+	if err != nil {
+		s.writeError(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	from, limit, err := s.parsePagination(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := s.store.ModerationLog(r.Context(), from, limit)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+	})
+}
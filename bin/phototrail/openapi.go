@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// openAPI serves the OpenAPI document of the API.
+func (s *service) openAPI(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	write(w, http.StatusOK, s.openAPIDocument())
+}
+
+// openAPIDocument describes the routes of the API in an OpenAPI 3 document.
+// The schemas of the payloads are derived from the types used by the
+// handlers, so the document follows the code.
+func (s *service) openAPIDocument() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(Error{}), schemas)},
+		},
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, rt := range s.routes() {
+		path, params := openAPIPath(rt.path)
+		for _, name := range rt.query {
+			params = append(params, map[string]interface{}{
+				"name":   name,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		var response interface{} = map[string]interface{}{"type": "object"}
+		if rt.response != nil {
+			response = schemaOf(reflect.TypeOf(rt.response), schemas)
+		}
+
+		operation := map[string]interface{}{
+			"operationId": strings.ToLower(rt.method) + strings.NewReplacer("/", "_", ":", "", "-", "_").Replace(rt.path),
+			"summary":     rt.summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Success",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": response},
+					},
+				},
+				"default": errorResponse,
+			},
+		}
+		if len(params) != 0 {
+			operation["parameters"] = params
+		}
+		if rt.public {
+			operation["security"] = []interface{}{}
+		}
+		if rt.body != "" {
+			var request interface{} = map[string]interface{}{"type": "object"}
+			if rt.request != nil {
+				request = schemaOf(reflect.TypeOf(rt.request), schemas)
+			} else if rt.body != "application/json" {
+				request = map[string]interface{}{"type": "string", "format": "binary"}
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{
+					rt.body: map[string]interface{}{"schema": request},
+				},
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(rt.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Phototrail",
+			"version": Version,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": apiPrefix},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+// openAPIPath converts the path of a route to the OpenAPI syntax, and returns
+// its parameters. The parameters named after an ID are integers.
+func openAPIPath(path string) (string, []interface{}) {
+	var params []interface{}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") {
+			continue
+		}
+		name := strings.TrimPrefix(segment, ":")
+		segments[i] = "{" + name + "}"
+
+		typ := "string"
+		if strings.HasSuffix(name, "_id") {
+			typ = "integer"
+		}
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": typ},
+		})
+	}
+	return strings.Join(segments, "/"), params
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaOf returns the schema of the JSON encoding of a type. The structs are
+// added to the schemas of the document, and referenced.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		schema := schemaOf(t.Elem(), schemas)
+		if _, ok := schema["$ref"]; ok {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		// The byte slices are encoded in base64 by encoding/json.
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := strings.Title(t.Name())
+		if _, ok := schemas[name]; !ok {
+			// The schema is registered before its fields are read, so the
+			// recursive types end.
+			schemas[name] = nil
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the schema of the JSON encoding of a struct. The fields
+// without omitempty are always present, and the limits of their validation
+// rules are given.
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+
+		property := schemaOf(field.Type, schemas)
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			rule, arg := splitRule(rule)
+			switch rule {
+			case "required":
+				if property["type"] == "string" {
+					property["minLength"] = 1
+				}
+			case "max":
+				property["maxLength"], _ = strconv.Atoi(arg)
+			}
+		}
+		properties[name] = property
+		if !strings.Contains(field.Tag.Get("json"), ",omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
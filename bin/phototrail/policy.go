@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Roles of the users. Everybody is a user, moderators can act on anybody's
+// content, and admins can do anything.
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// roleRanks orders the roles, from the least to the most privileged.
+var roleRanks = map[string]int{
+	roleUser:      0,
+	roleModerator: 1,
+	roleAdmin:     2,
+}
+
+// permission is an action subject to authorization.
+type permission string
+
+const (
+	permCreatePost     permission = "create post"
+	permComment        permission = "comment post"
+	permLike           permission = "like post"
+	permCreateAlbum    permission = "create album"
+	permReport         permission = "report content"
+	permImport         permission = "import posts"
+	permExport         permission = "export data"
+	permDeleteAccount  permission = "delete account"
+	permEditPost       permission = "edit post"
+	permDeletePost     permission = "delete post"
+	permEditComment    permission = "edit comment"
+	permDeleteComment  permission = "delete comment"
+	permViewAlbum      permission = "view album"
+	permEditAlbum      permission = "edit album"
+	permDeleteAlbum    permission = "delete album"
+	permShareAlbum     permission = "share album"
+	permEditAlbumPosts permission = "edit album posts"
+	permLeaveAlbum     permission = "leave album"
+	permModerate       permission = "moderate content"
+	permBanUser        permission = "ban user"
+	permBackup         permission = "back up data"
+)
+
+// subject describes the content a permission is checked against.
+type subject struct {
+	// OwnerID is the ID of the user the content belongs to.
+	OwnerID int
+	// Collaborator is set if the user has been granted access to the content
+	// by its owner.
+	Collaborator bool
+	// UserID is the ID of the user the action is about, if any.
+	UserID int
+	// UserRole is the role of the user the action is about, if it matters.
+	// Nobody can act on a user of the same or a higher role.
+	UserRole string
+}
+
+// errForbidden is returned when a user isn't allowed to do something. It must
+// be answered with a 403.
+var errForbidden = errors.New("forbidden")
+
+// authorize is the policy of the service: it tells if the user is allowed the
+// permission on the subject, and returns a wrapped errForbidden if not.
+func authorize(u user, p permission, sub subject) error {
+	if sub.UserRole != "" && roleRanks[sub.UserRole] >= roleRanks[u.Role] {
+		return &apiError{status: http.StatusForbidden, code: "forbidden", message: fmt.Sprintf("can't %s with role %s", p, sub.UserRole), cause: errForbidden}
+	}
+
+	if u.Role == roleAdmin {
+		return nil
+	}
+
+	var allowed bool
+	switch p {
+	case permCreatePost, permComment, permLike, permCreateAlbum, permReport, permImport:
+		// Everybody can contribute, the banned and suspended users are
+		// already refused when authenticating.
+		allowed = true
+	case permExport, permDeleteAccount:
+		// Everybody can take away or delete their own data.
+		allowed = true
+	case permEditPost, permEditComment, permEditAlbum, permShareAlbum:
+		allowed = sub.OwnerID == u.ID
+	case permDeletePost, permDeleteComment, permDeleteAlbum:
+		allowed = sub.OwnerID == u.ID || u.Role == roleModerator
+	case permViewAlbum, permEditAlbumPosts:
+		allowed = sub.OwnerID == u.ID || sub.Collaborator
+	case permLeaveAlbum:
+		allowed = sub.OwnerID == u.ID || sub.UserID == u.ID
+	case permModerate:
+		allowed = u.Role == roleModerator
+	case permBanUser, permBackup:
+		allowed = u.Role == roleAdmin
+	}
+
+	if !allowed {
+		return &apiError{status: http.StatusForbidden, code: "forbidden", message: fmt.Sprintf("can't %s", p), cause: errForbidden}
+	}
+	return nil
+}
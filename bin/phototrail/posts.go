@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go4.org/syncutil"
+)
+
+// cursor is the position of a post in the feed. Posts are ordered by date,
+// then by ID for the posts created in the same second. Cursors are opaque to
+// the clients, which must only pass back the ones they were given.
+type cursor struct {
+	ID        int       `db:"id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// createdAt returns the date of the cursor in the format of the database, so
+// it can be compared with the dates stored.
+func (c cursor) createdAt() string {
+	return c.CreatedAt.UTC().Format(sqliteTime)
+}
+
+func (c cursor) MarshalText() ([]byte, error) {
+	raw := fmt.Sprintf("%d:%d", c.CreatedAt.Unix(), c.ID)
+	return []byte(base64.RawURLEncoding.EncodeToString([]byte(raw))), nil
+}
+
+func (c *cursor) UnmarshalText(text []byte) error {
+	raw, err := base64.RawURLEncoding.DecodeString(string(text))
+	if err != nil {
+		return errors.New("invalid cursor")
+	}
+
+	var timestamp int64
+	_, err = fmt.Sscanf(string(raw), "%d:%d", &timestamp, &c.ID)
+	if err != nil {
+		return errors.New("invalid cursor")
+	}
+	c.CreatedAt = time.Unix(timestamp, 0).UTC()
+	return nil
+}
+
+// page is the part of a list of posts requested by a client.
+type page struct {
+	before *cursor
+	since  *cursor
+	limit  uint64
+}
+
+// parsePage reads the 'cursor', 'since' and 'limit' parameters of the lists
+// of posts paginated with cursors.
+func (s *service) parsePage(r *http.Request) (page, error) {
+	from, limit, err := s.parsePagination(r)
+	if err != nil {
+		return page{}, err
+	}
+	p := page{limit: limit}
+
+	// The lists are paginated with cursors rather than dates, so the posts
+	// created in the same second aren't skipped or repeated between pages.
+	// The 'from' parameter is still accepted for the older clients.
+	if raw := r.URL.Query().Get("cursor"); raw != "" {
+		p.before = new(cursor)
+		err = p.before.UnmarshalText([]byte(raw))
+		if err != nil {
+			return page{}, invalidParameter("cursor", err)
+		}
+	} else if r.URL.Query().Get("from") != "" {
+		p.before = &cursor{CreatedAt: from}
+	}
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		p.since = new(cursor)
+		err = p.since.UnmarshalText([]byte(raw))
+		if err != nil {
+			return page{}, invalidParameter("since", err)
+		}
+	}
+
+	return p, nil
+}
+
+// conditions returns the conditions selecting the rows of the page, to append
+// to the where clause of a query on the id and created_at columns of the
+// table of the alias, along their arguments and the order to fetch the rows
+// in. The newer rows are fetched from the cursor upward, so a client can
+// catch up page by page.
+func (p page) conditions(alias string) (string, []interface{}, string) {
+	var conditions []string
+	var args []interface{}
+	if p.before != nil {
+		conditions = append(conditions, fmt.Sprintf(`and (%[1]screated_at < ? or (%[1]screated_at = ? and %[1]sid < ?))`, alias))
+		args = append(args, p.before.createdAt(), p.before.createdAt(), p.before.ID)
+	}
+	if p.since != nil {
+		conditions = append(conditions, fmt.Sprintf(`and (%[1]screated_at > ? or (%[1]screated_at = ? and %[1]sid > ?))`, alias))
+		args = append(args, p.since.createdAt(), p.since.createdAt(), p.since.ID)
+	}
+
+	order := "desc"
+	if p.since != nil {
+		order = "asc"
+	}
+	return strings.Join(conditions, "\n"), args, order
+}
+
+// cut trims the rows fetched for the page, one more than its limit to know if
+// there is a next page, and returns them in reverse chronological order along
+// the cursors of the next and previous pages. The next cursor goes further in
+// the past, and the previous one is the position to fetch the newer rows
+// from.
+func (p page) cut(rows []cursor) ([]cursor, *cursor, *cursor) {
+	more := uint64(len(rows)) > p.limit
+	if more {
+		rows = rows[:p.limit]
+	}
+	if p.since != nil {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	var next, previous *cursor
+	if more && p.since == nil {
+		next = &rows[len(rows)-1]
+	}
+	if len(rows) != 0 {
+		previous = &rows[0]
+	} else {
+		previous = p.since
+	}
+	return rows, next, previous
+}
+
+// listPosts returns a page of the visible posts matching the condition, which
+// is appended to the where clause of the query.
+func (s *service) listPosts(ctx context.Context, p page, condition string, args ...interface{}) (feed, error) {
+	conditions, pageArgs, order := p.conditions("")
+
+	// Retrieve the post IDs first, as we will need them for various things.
+	// It also makes a nice late row retrieval.
+	var rows []cursor
+	err := s.reader.SelectContext(ctx, &rows, fmt.Sprintf(`
+		select id, created_at
+		from posts
+		where hidden_at is null
+		%s
+		%s
+		%s
+		order by created_at %s, id %s
+		limit ?
+	`, condition, conditions, s.restrictedFilter("user_id"), order, order), append(append(args, pageArgs...), p.limit+1)...)
+	if err != nil {
+		return feed{}, wrap(err, "querying posts")
+	}
+
+	var f feed
+	rows, f.NextCursor, f.PreviousCursor = p.cut(rows)
+
+	var postIDs = make([]int, len(rows))
+	for i, row := range rows {
+		postIDs[i] = row.ID
+	}
+
+	f.Posts, err = s.hydratePosts(ctx, postIDs)
+	if err != nil {
+		return feed{}, wrap(err, "hydrating posts")
+	}
+
+	return f, nil
+}
+
+// hydratePosts retrieves the posts for the given IDs along with their images,
+// likes, comments and entities. The posts are returned in reverse
+// chronological order. The parts of the posts are retrieved concurrently.
+func (s *service) hydratePosts(ctx context.Context, postIDs []int) ([]post, error) {
+	if len(postIDs) == 0 {
+		return nil, nil
+	}
+
+	var posts []post
+	var images map[int][]string
+	var likes map[int][]like
+	var comments map[int][]comment
+	var e entities
+
+	var g syncutil.Group
+	g.Go(func() (err error) {
+		posts, err = s.store.Posts(ctx, postIDs)
+		return err
+	})
+	g.Go(func() (err error) {
+		images, err = s.store.Images(ctx, postIDs)
+		return err
+	})
+	g.Go(func() (err error) {
+		likes, err = s.store.Likes(ctx, postIDs)
+		return err
+	})
+	g.Go(func() (err error) {
+		comments, err = s.store.Comments(ctx, postIDs)
+		return err
+	})
+	g.Go(func() (err error) {
+		e, err = s.queryEntities(ctx, postIDs)
+		return err
+	})
+	err := g.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// Reconstruct the posts.
+	for i, p := range posts {
+		p.Likes = likes[p.ID]
+		p.Images = images[p.ID]
+		p.Comments = comments[p.ID]
+		p.Tags = e.tags[entityKey{PostID: p.ID}]
+		p.Mentions = e.mentions[entityKey{PostID: p.ID}]
+		for j, c := range p.Comments {
+			c.Tags = e.tags[entityKey{PostID: p.ID, CommentID: c.ID}]
+			c.Mentions = e.mentions[entityKey{PostID: p.ID, CommentID: c.ID}]
+			p.Comments[j] = c
+		}
+		posts[i] = p
+	}
+
+	return posts, nil
+}
+
+func (s *service) getPost(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// The router doesn't allow a static segment next to a parameter, so the
+	// posts near a point are served from here.
+	if p.ByName("post_id") == "near" {
+		s.nearPosts(w, r, p)
+		return
+	}
+
+	_, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	postID, err := strconv.ParseInt(p.ByName("post_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("post_id", err))
+		return
+	}
+
+	version, err := s.store.ContentVersion(r.Context())
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if s.notModified(w, r, version) || s.cachedResponse(w, r, version) {
+		return
+	}
+
+	var id int
+	err = s.reader.GetContext(r.Context(), &id, fmt.Sprintf(`
+		select id
+		from posts
+		where id = ?
+		and hidden_at is null
+		%s
+	`, s.restrictedFilter("user_id")), postID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.writeError(w, r, http.StatusNotFound, errPostNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "querying post"))
+		return
+	}
+
+	posts, err := s.hydratePosts(r.Context(), []int{id})
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "hydrating posts"))
+		return
+	}
+	if len(posts) == 0 {
+		s.writeError(w, r, http.StatusNotFound, errPostNotFound)
+		return
+	}
+
+	s.writeCached(w, r, version, posts[0])
+}
+
+func (s *service) userPosts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	userID, err := strconv.ParseInt(p.ByName("user_id"), 10, 64)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, invalidParameter("user_id", err))
+		return
+	}
+
+	pg, err := s.parsePage(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	var u user
+	err = s.reader.GetContext(r.Context(), &u, `
+		select id, name
+		from users
+		where id = ?
+	`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.writeError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "querying user"))
+		return
+	}
+
+	f, err := s.listPosts(r.Context(), pg, `and user_id = ?`, u.ID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, http.StatusOK, f)
+}
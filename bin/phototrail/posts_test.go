@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursor(t *testing.T) {
+	c := cursor{ID: 42, CreatedAt: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)}
+	raw, err := c.MarshalText()
+	if err != nil {
+		t.Fatalf("marshaling cursor: %s", err)
+	}
+
+	var parsed cursor
+	err = parsed.UnmarshalText(raw)
+	if err != nil {
+		t.Fatalf("unmarshaling cursor %q: %s", raw, err)
+	}
+	if parsed.ID != c.ID || !parsed.CreatedAt.Equal(c.CreatedAt) {
+		t.Errorf("unmarshaled %+v, expected %+v", parsed, c)
+	}
+
+	for _, raw := range []string{"", "!!!", "YWJj", "MTIzOmFiYw"} {
+		err = new(cursor).UnmarshalText([]byte(raw))
+		if err == nil {
+			t.Errorf("unmarshaling %q: expected an error", raw)
+		}
+	}
+}
+
+func TestListPosts(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	userID, err := s.store.CreateUser(ctx, "sub", "alice")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+
+	// Posts 1 to 3 are created in the same second, so only their ID orders
+	// them, and posts 4 and 5 an hour before.
+	now := time.Now().UTC().Truncate(time.Second)
+	earlier := now.Add(-time.Hour)
+	for _, createdAt := range []time.Time{now, now, now, earlier, earlier} {
+		_, _, _, err = s.store.CreatePost(ctx, userID, post{Text: "post", CreatedAt: createdAt}, true)
+		if err != nil {
+			t.Fatalf("creating post: %s", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		page     page
+		posts    []int
+		next     *cursor
+		previous *cursor
+	}{
+		{
+			name:     "first page",
+			page:     page{limit: 2},
+			posts:    []int{3, 2},
+			next:     &cursor{ID: 2, CreatedAt: now},
+			previous: &cursor{ID: 3, CreatedAt: now},
+		},
+		{
+			name:     "single post",
+			page:     page{limit: 1},
+			posts:    []int{3},
+			next:     &cursor{ID: 3, CreatedAt: now},
+			previous: &cursor{ID: 3, CreatedAt: now},
+		},
+		{
+			name:     "page of all the posts",
+			page:     page{limit: 5},
+			posts:    []int{3, 2, 1, 5, 4},
+			previous: &cursor{ID: 3, CreatedAt: now},
+		},
+		{
+			name:     "limit above the number of posts",
+			page:     page{limit: 10},
+			posts:    []int{3, 2, 1, 5, 4},
+			previous: &cursor{ID: 3, CreatedAt: now},
+		},
+		{
+			name:     "page across seconds",
+			page:     page{before: &cursor{ID: 2, CreatedAt: now}, limit: 2},
+			posts:    []int{1, 5},
+			next:     &cursor{ID: 5, CreatedAt: earlier},
+			previous: &cursor{ID: 1, CreatedAt: now},
+		},
+		{
+			name:     "last page",
+			page:     page{before: &cursor{ID: 5, CreatedAt: earlier}, limit: 2},
+			posts:    []int{4},
+			previous: &cursor{ID: 4, CreatedAt: earlier},
+		},
+		{
+			name:     "past the last page",
+			page:     page{before: &cursor{ID: 4, CreatedAt: earlier}, limit: 2},
+			posts:    []int{},
+			previous: nil,
+		},
+		{
+			name:     "newer posts",
+			page:     page{since: &cursor{ID: 5, CreatedAt: earlier}, limit: 2},
+			posts:    []int{2, 1},
+			previous: &cursor{ID: 2, CreatedAt: now},
+		},
+		{
+			name:     "no newer posts",
+			page:     page{since: &cursor{ID: 3, CreatedAt: now}, limit: 2},
+			posts:    []int{},
+			previous: &cursor{ID: 3, CreatedAt: now},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := s.listPosts(ctx, tc.page, "")
+			if err != nil {
+				t.Fatalf("listing posts: %s", err)
+			}
+			if ids := postIDs(f); !reflect.DeepEqual(ids, tc.posts) {
+				t.Errorf("got posts %v, expected %v", ids, tc.posts)
+			}
+			if !sameCursor(f.NextCursor, tc.next) {
+				t.Errorf("got next cursor %+v, expected %+v", f.NextCursor, tc.next)
+			}
+			if !sameCursor(f.PreviousCursor, tc.previous) {
+				t.Errorf("got previous cursor %+v, expected %+v", f.PreviousCursor, tc.previous)
+			}
+		})
+	}
+
+	// The limit must be at least 1, and is capped to the maximum page size.
+	for _, tc := range []struct {
+		query string
+		limit uint64
+		err   bool
+	}{
+		{query: "limit=0", err: true},
+		{query: "limit=1", limit: 1},
+		{query: "limit=1000", limit: s.maxPageSize},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			pg, err := s.parsePage(httptest.NewRequest(http.MethodGet, "/feed?"+tc.query, nil))
+			if tc.err != (err != nil) {
+				t.Fatalf("got error %v, expected an error: %t", err, tc.err)
+			}
+			if pg.limit != tc.limit {
+				t.Errorf("got limit %d, expected %d", pg.limit, tc.limit)
+			}
+		})
+	}
+
+	// Following the next cursors goes through all the posts once.
+	var all []int
+	p := page{limit: 2}
+	for {
+		f, err := s.listPosts(ctx, p, "")
+		if err != nil {
+			t.Fatalf("listing posts: %s", err)
+		}
+		all = append(all, postIDs(f)...)
+		if f.NextCursor == nil {
+			break
+		}
+		p.before = f.NextCursor
+	}
+	if expected := []int{3, 2, 1, 5, 4}; !reflect.DeepEqual(all, expected) {
+		t.Errorf("paging through the posts got %v, expected %v", all, expected)
+	}
+}
+
+// postIDs returns the IDs of the posts of a feed, in order.
+func postIDs(f feed) []int {
+	ids := []int{}
+	for _, p := range f.Posts {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// sameCursor checks if two cursors designate the same position.
+func sameCursor(a, b *cursor) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ID == b.ID && a.CreatedAt.Equal(b.CreatedAt)
+}
+
+func TestCreatePost(t *testing.T) {
+	s := newTestService(t)
+	s.maxImageSize = 16
+	ctx := context.Background()
+
+	userID, err := s.store.CreateUser(ctx, "sub", "alice")
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	s.cache.SetDefault("Bearer alice", user{ID: userID, Name: "alice", Role: roleUser})
+
+	for _, tc := range []struct {
+		name    string
+		payload string
+		status  int
+		images  int
+	}{
+		{name: "text", payload: `{"text": "hello"}`, status: http.StatusOK},
+		{name: "images", payload: `{"images": ["aW1hZ2U="]}`, status: http.StatusOK, images: 1},
+		{name: "empty", payload: `{"text": "  "}`, status: http.StatusBadRequest},
+		{name: "long place", payload: `{"text": "hello", "place": "` + strings.Repeat("a", 256) + `"}`, status: http.StatusBadRequest},
+		{name: "images too large", payload: `{"images": ["aW1hZ2U=", "bGFyZ2VyIGltYWdl"]}`, status: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/posts", strings.NewReader(tc.payload))
+			r.Header.Set("Authorization", "Bearer alice")
+			s.createPost(w, r, nil)
+			if w.Code != tc.status {
+				t.Fatalf("got status %d, expected %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var res struct {
+				PostID int64    `json:"post_id"`
+				Images []string `json:"images"`
+			}
+			err := json.NewDecoder(w.Body).Decode(&res)
+			if err != nil {
+				t.Fatalf("decoding response: %s", err)
+			}
+			images, err := s.store.Images(ctx, []int{int(res.PostID)})
+			if err != nil {
+				t.Fatalf("listing images: %s", err)
+			}
+			if len(res.Images) != tc.images || len(images[int(res.PostID)]) != tc.images {
+				t.Errorf("got images %v and %v, expected %d", res.Images, images, tc.images)
+			}
+		})
+	}
+
+	// Only the valid posts are kept.
+	var count int
+	err = s.reader.Get(&count, `select count(*) from posts`)
+	if err != nil {
+		t.Fatalf("counting posts: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("got %d posts, expected 2", count)
+	}
+}
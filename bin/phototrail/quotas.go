@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// errQuotaExceeded is returned when storing an image would exceed the quota of
+// the user.
+var errQuotaExceeded = &apiError{status: http.StatusRequestEntityTooLarge, code: "quota_exceeded", message: "storage quota exceeded"}
+
+// errImageTooLarge is returned when an image exceeds the size allowed for the
+// images.
+var errImageTooLarge = &apiError{status: http.StatusRequestEntityTooLarge, code: "image_too_large", message: "image too large"}
+
+// imageLimit returns the size allowed for the next image of a user: the
+// maximum size of the images, or the space left in the quota of the user if
+// smaller, along the error for the images exceeding it. The images the user
+// already stored are counted as new ones, so they can be refused before
+// being read.
+func (s *service) imageLimit(ctx context.Context, userID int) (int64, *apiError, error) {
+	quota, err := s.storageQuota(ctx, userID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if quota == 0 {
+		return s.maxImageSize, errImageTooLarge, nil
+	}
+
+	used, _, err := s.store.StorageUsage(ctx, userID)
+	if err != nil {
+		return 0, nil, err
+	}
+	remaining := quota - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	if remaining < s.maxImageSize {
+		return remaining, errQuotaExceeded, nil
+	}
+	return s.maxImageSize, errImageTooLarge, nil
+}
+
+// imagePath returns the path an image is stored at, relative to the images
+// directory. Images are stored by hash, so the same image is only stored once.
+func imagePath(raw []byte) string {
+	hash := fmt.Sprintf(`%x`, md5.Sum(raw))
+	return filepath.Join(hash[:2], hash[2:])
+}
+
+// storageQuota returns the number of bytes a user can store, or 0 if the user
+// has no quota.
+func (s *service) storageQuota(ctx context.Context, userID int) (int64, error) {
+	quota, err := s.store.StorageQuota(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if !quota.Valid {
+		return s.storageQuotaDefault, nil
+	}
+	return quota.Int64, nil
+}
+
+// recomputeImageSizes records the size of the stored images, as found on the
+// disk, and returns the number of images whose size changed.
+func (s *service) recomputeImageSizes(ctx context.Context) (int, error) {
+	images, err := s.store.ImageSizes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for path, recorded := range images {
+		var size int64
+		info, err := os.Stat(filepath.Join(s.dataDir, "images", path))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return count, wrap(err, "reading %s", path)
+		}
+		if err == nil {
+			size = info.Size()
+		}
+		if size == recorded {
+			continue
+		}
+
+		err = s.store.SetImageSize(ctx, path, size)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (s *service) usage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	used, images, err := s.store.StorageUsage(r.Context(), u.ID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	quota, err := s.storageQuota(r.Context(), u.ID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	var payload = map[string]interface{}{
+		"used":   used,
+		"images": images,
+		"quota":  nil,
+	}
+	if quota != 0 {
+		payload["quota"] = quota
+	}
+	write(w, http.StatusOK, payload)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/urfave/negroni"
+	"golang.org/x/time/rate"
+)
+
+// Classes of routes, each with its own rate limit.
+const (
+	rateRead   = "read"
+	rateWrite  = "write"
+	rateUpload = "upload"
+	rateAuth   = "auth"
+)
+
+// unlimitedRoutes are the routes used by the infrastructure, which must never
+// be throttled.
+var unlimitedRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// rateLimit is a token bucket limit, given as a number of requests over a
+// period (e.g. 60/1m). The bucket holds as many requests as the period
+// allows, so a client can use its whole allowance at once. A limit of 0
+// disables the limiting.
+type rateLimit struct {
+	requests int
+	period   time.Duration
+}
+
+func (l *rateLimit) String() string {
+	if l.requests == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.requests, l.period)
+}
+
+func (l *rateLimit) Set(value string) error {
+	if value == "0" {
+		*l = rateLimit{}
+		return nil
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid rate limit %q, expected <requests>/<period>", value)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 0 {
+		return fmt.Errorf("invalid number of requests %q", parts[0])
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid period %q", parts[1])
+	}
+
+	*l = rateLimit{requests: requests, period: period}
+	return nil
+}
+
+// networks is a list of networks given as a comma-separated list of
+// addresses or CIDRs.
+type networks []*net.IPNet
+
+func (n *networks) String() string {
+	var values []string
+	for _, network := range *n {
+		values = append(values, network.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func (n *networks) Set(value string) error {
+	*n = nil
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			*n = append(*n, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", v)
+		}
+		*n = append(*n, network)
+	}
+	return nil
+}
+
+// contains checks if the address belongs to one of the networks.
+func (n networks) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of the request. The
+// X-Forwarded-For header is only used when the request comes from a trusted
+// proxy, in which case the client is the last address of the chain that isn't
+// a trusted proxy: the ones before it can be forged by the client.
+func (s *service) clientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !s.trustedProxies.contains(addr) {
+		return addr
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr = strings.TrimSpace(forwarded[i])
+		if !s.trustedProxies.contains(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// routeClass returns the class of rate limit of a route.
+func routeClass(method, route string) string {
+	switch method + " " + apiRoute(route) {
+	case "GET /login", "POST /refresh":
+		return rateAuth
+	case "POST /posts/:post_id/images", "POST /me/import":
+		return rateUpload
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return rateRead
+	default:
+		return rateWrite
+	}
+}
+
+// limitRate is a middleware throttling the clients making too many requests.
+// Authenticated users are limited by user, and the others by address.
+func (s *service) limitRate(router *httprouter.Router) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		route := "unmatched"
+		if h, params, _ := router.Lookup(r.Method, r.URL.Path); h != nil {
+			route = routePattern(r.URL.Path, params)
+		}
+		if unlimitedRoutes[route] {
+			next(rw, r)
+			return
+		}
+
+		key := "ip:" + s.clientIP(r)
+
+		// The users are only known once their token has been checked. The
+		// tokens that aren't in the cache yet cost a request to the identity
+		// provider, so they are limited as authentications.
+		if header := r.Header.Get("Authorization"); header != "" {
+			if v, ok := s.cache.Get(header); ok {
+				key = fmt.Sprintf("user:%d", v.(user).ID)
+			} else if !s.allow(rw, r, rateAuth, key) {
+				return
+			}
+		}
+
+		if !s.allow(rw, r, routeClass(r.Method, route), key) {
+			return
+		}
+
+		next(rw, r)
+	}
+}
+
+// allow takes a request from the bucket of the client for the class, or
+// answers with a 429 telling the client when to retry.
+func (s *service) allow(w http.ResponseWriter, r *http.Request, class, key string) bool {
+	limit := s.rateLimits[class]
+	if limit.requests == 0 {
+		return true
+	}
+
+	reservation := s.limiter(class+"|"+key, limit).Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return true
+	}
+	reservation.Cancel()
+
+	s.metrics.rateLimited.WithLabelValues(class).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	s.writeError(w, r, http.StatusTooManyRequests, fmt.Errorf("too many %s requests", class))
+	return false
+}
+
+// limiter returns the limiter of a client for a class, creating it if needed.
+func (s *service) limiter(key string, limit *rateLimit) *rate.Limiter {
+	s.limitersMutex.Lock()
+	defer s.limitersMutex.Unlock()
+
+	v, ok := s.limiters.Get(key)
+	if !ok {
+		v = rate.NewLimiter(rate.Limit(float64(limit.requests)/limit.period.Seconds()), limit.requests)
+	}
+
+	// A limiter unused for a whole period is full again, so it can be
+	// forgotten until the client comes back.
+	s.limiters.Set(key, v, limit.period)
+	return v.(*rate.Limiter)
+}
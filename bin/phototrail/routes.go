@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiPrefix is the prefix of the routes of the current version of the API.
+const apiPrefix = "/api/v1"
+
+// loginCallbackPath is the path the identity provider redirects to after a
+// login. It is the alias of the login route at the root, which must be kept
+// as long as it is the callback allowed by the identity provider.
+const loginCallbackPath = "/login"
+
+// route is an endpoint of the API. The routes are served under the prefix of
+// the API, and at the root as deprecated aliases for the older clients. They
+// are also described by the OpenAPI document, so the table is the reference
+// of what the API is.
+type route struct {
+	method  string
+	path    string
+	handle  httprouter.Handle
+	summary string
+
+	// public routes don't require authentication.
+	public bool
+
+	// query lists the parameters of the query string.
+	query []string
+
+	// request and response are values of the types of the payloads, or nil
+	// for a JSON object without a fixed shape. The request is only read if
+	// the content type of the body is given.
+	body     string
+	request  interface{}
+	response interface{}
+
+	// dispatched routes are served by the handler of a route with a parameter
+	// at the same place, as the router doesn't allow both.
+	dispatched bool
+}
+
+// routes returns the table of the routes of the API.
+func (s *service) routes() []route {
+	return []route{
+		{method: http.MethodGet, path: "/about", handle: s.about, summary: "Version of the service", public: true},
+		{method: http.MethodGet, path: "/login", handle: s.login, summary: "Log in with the identity provider", public: true, query: []string{"code", "state"}},
+		{method: http.MethodGet, path: "/logout", handle: s.logout, summary: "Log out from the identity provider", public: true},
+		{method: http.MethodPost, path: "/refresh", handle: s.refresh, summary: "Refresh an access token", public: true, body: "application/json", response: token{}},
+		{method: http.MethodGet, path: "/me", handle: s.me, summary: "Current user"},
+		{method: http.MethodDelete, path: "/me", handle: s.deleteMe, summary: "Schedule the deletion of the account", body: "application/json"},
+		{method: http.MethodPost, path: "/me/cancel-deletion", handle: s.cancelDeletion, summary: "Cancel the deletion of the account"},
+		{method: http.MethodGet, path: "/me/usage", handle: s.usage, summary: "Storage used by the current user"},
+		{method: http.MethodPost, path: "/me/import", handle: s.importPosts, summary: "Import the posts of another service", query: []string{"source"}, body: "application/zip"},
+		{method: http.MethodPost, path: "/me/export", handle: s.createExport, summary: "Start an export of the personal data", response: export{}},
+		{method: http.MethodGet, path: "/me/export/:export_id", handle: s.getExport, summary: "Status or archive of an export", response: export{}},
+		{method: http.MethodGet, path: "/feed", handle: s.feed, summary: "Feed of the posts", query: []string{"cursor", "since", "limit", "from"}, response: feed{}},
+		{method: http.MethodPost, path: "/posts", handle: s.createPost, summary: "Create a post", body: "application/json", request: postPayload{}},
+		{method: http.MethodGet, path: "/posts/near", handle: s.nearPosts, summary: "Posts in a bounding box", query: []string{"bbox", "cursor", "since", "limit", "from"}, response: feed{}, dispatched: true},
+		{method: http.MethodGet, path: "/posts/:post_id", handle: s.getPost, summary: "A single post", response: post{}},
+		{method: http.MethodPatch, path: "/posts/:post_id", handle: s.updatePost, summary: "Edit the text of a post", body: "application/json"},
+		{method: http.MethodDelete, path: "/posts/:post_id", handle: s.deletePost, summary: "Delete a post"},
+		{method: http.MethodPost, path: "/posts/:post_id/images", handle: s.uploadImage, summary: "Add an image to a post", query: []string{"geotag"}, body: "application/octet-stream"},
+		{method: http.MethodPost, path: "/posts/:post_id/like", handle: s.likePost, summary: "Like a post"},
+		{method: http.MethodDelete, path: "/posts/:post_id/like", handle: s.unlikePost, summary: "Remove the like of a post"},
+		{method: http.MethodPost, path: "/posts/:post_id/comments", handle: s.createComment, summary: "Comment a post", body: "application/json", request: commentPayload{}},
+		{method: http.MethodPatch, path: "/posts/:post_id/comments/:comment_id", handle: s.updateComment, summary: "Edit the text of a comment", body: "application/json"},
+		{method: http.MethodDelete, path: "/posts/:post_id/comments/:comment_id", handle: s.deleteComment, summary: "Delete a comment"},
+		{method: http.MethodGet, path: "/tags/:tag/posts", handle: s.tagPosts, summary: "Posts with a tag", query: []string{"cursor", "since", "limit", "from"}, response: feed{}},
+		{method: http.MethodGet, path: "/notifications", handle: s.notifications, summary: "Notifications of the current user", query: []string{"from", "limit"}},
+		{method: http.MethodPost, path: "/notifications/read", handle: s.readNotifications, summary: "Mark the notifications as read"},
+		{method: http.MethodGet, path: "/albums", handle: s.listAlbums, summary: "Albums of the current user", query: []string{"cursor", "since", "limit"}, response: albumList{}},
+		{method: http.MethodPost, path: "/albums", handle: s.createAlbum, summary: "Create an album", body: "application/json", request: album{}},
+		{method: http.MethodGet, path: "/albums/:album_id", handle: s.getAlbum, summary: "An album", response: album{}},
+		{method: http.MethodPut, path: "/albums/:album_id", handle: s.updateAlbum, summary: "Update an album", body: "application/json", request: album{}},
+		{method: http.MethodDelete, path: "/albums/:album_id", handle: s.deleteAlbum, summary: "Delete an album"},
+		{method: http.MethodGet, path: "/albums/:album_id/posts", handle: s.albumPosts, summary: "Posts of an album", query: []string{"cursor", "since", "limit", "from"}, response: feed{}},
+		{method: http.MethodPost, path: "/albums/:album_id/posts", handle: s.addAlbumPost, summary: "Add a post to an album", body: "application/json"},
+		{method: http.MethodDelete, path: "/albums/:album_id/posts/:post_id", handle: s.removeAlbumPost, summary: "Remove a post from an album"},
+		{method: http.MethodPost, path: "/albums/:album_id/collaborators", handle: s.addAlbumCollaborator, summary: "Add a collaborator to an album", body: "application/json"},
+		{method: http.MethodDelete, path: "/albums/:album_id/collaborators/:user_id", handle: s.removeAlbumCollaborator, summary: "Remove a collaborator from an album"},
+		{method: http.MethodGet, path: "/users/:user_id/posts", handle: s.userPosts, summary: "Posts of a user", query: []string{"cursor", "since", "limit", "from"}, response: feed{}},
+		{method: http.MethodGet, path: "/users/:user_id/trail", handle: s.trail, summary: "Trail of a user, as GeoJSON", response: featureCollection{}},
+		{method: http.MethodPost, path: "/users/:user_id/ban", handle: s.banUser, summary: "Ban or suspend a user", body: "application/json"},
+		{method: http.MethodDelete, path: "/users/:user_id/ban", handle: s.unbanUser, summary: "Lift the ban or suspension of a user", body: "application/json"},
+		{method: http.MethodPost, path: "/reports", handle: s.createReport, summary: "Report a post, comment or user", body: "application/json", request: report{}},
+		{method: http.MethodGet, path: "/reports", handle: s.listReports, summary: "Reports to review", query: []string{"status", "from", "limit"}},
+		{method: http.MethodPost, path: "/reports/:report_id/resolve", handle: s.resolveReport, summary: "Resolve a report", body: "application/json"},
+		{method: http.MethodGet, path: "/moderation/log", handle: s.moderationLog, summary: "Log of the moderation actions", query: []string{"from", "limit"}},
+		{method: http.MethodGet, path: "/admin/backup", handle: s.downloadBackup, summary: "Backup archive of the data directory"},
+	}
+}
+
+// registerRoutes registers the routes of the API under its prefix and at the
+// root, and the OpenAPI document describing them.
+func (s *service) registerRoutes(router *httprouter.Router) {
+	for _, r := range s.routes() {
+		if r.dispatched {
+			continue
+		}
+		router.Handle(r.method, apiPrefix+r.path, r.handle)
+		router.Handle(r.method, r.path, deprecated(r.handle))
+	}
+	router.GET(apiPrefix+"/openapi.json", s.openAPI)
+}
+
+// deprecated marks the responses of an alias of a route of the API, and
+// points to the route to use instead.
+func deprecated(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiPrefix+r.URL.Path+`>; rel="successor-version"`)
+		handle(w, r, p)
+	}
+}
+
+// apiRoute returns the route of the API matched by a pattern, whether it is
+// served under the prefix of the API or at the root.
+func apiRoute(pattern string) string {
+	if strings.HasPrefix(pattern, apiPrefix+"/") {
+		return strings.TrimPrefix(pattern, apiPrefix)
+	}
+	return pattern
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TestRoutesDocumented checks that the router and the OpenAPI document agree:
+// each documented path is served with exactly the documented methods, and
+// each route of the table is documented.
+func TestRoutesDocumented(t *testing.T) {
+	s := &service{}
+	router := httprouter.New()
+	s.registerRoutes(router)
+
+	paths, ok := s.openAPIDocument()["paths"].(map[string]map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected type of the paths of the document")
+	}
+
+	for _, rt := range s.routes() {
+		path, _ := openAPIPath(rt.path)
+		if _, ok := paths[path][strings.ToLower(rt.method)]; !ok {
+			t.Errorf("%s %s isn't documented", rt.method, rt.path)
+		}
+	}
+
+	// The dispatched routes share the methods of the route with a parameter
+	// at their place, so only the documented ones are checked for them.
+	dispatched := make(map[string]bool)
+	for _, rt := range s.routes() {
+		if rt.dispatched {
+			path, _ := openAPIPath(rt.path)
+			dispatched[path] = true
+		}
+	}
+
+	// The router answers the OPTIONS requests with the methods it serves
+	// for the path.
+	param := regexp.MustCompile(`{[^}]+}`)
+	for path, operations := range paths {
+		var documented []string
+		for method := range operations {
+			documented = append(documented, strings.ToUpper(method))
+		}
+		sort.Strings(documented)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, apiPrefix+param.ReplaceAllString(path, "1"), nil))
+		var served []string
+		for _, method := range strings.Split(w.Header().Get("Allow"), ", ") {
+			if method != "" && method != http.MethodOptions {
+				served = append(served, method)
+			}
+		}
+		sort.Strings(served)
+
+		for _, method := range documented {
+			if !contains(served, method) {
+				t.Errorf("%s %s is documented but not served", method, path)
+			}
+		}
+		if dispatched[path] {
+			continue
+		}
+		for _, method := range served {
+			if !contains(documented, method) {
+				t.Errorf("%s %s is served but not documented", method, path)
+			}
+		}
+	}
+}
+
+// contains checks if a list of strings contains a value.
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
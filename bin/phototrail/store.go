@@ -0,0 +1,1327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Store is the storage of the users, posts, images, likes, comments, albums,
+// reports, exports and imports. The lookups of a missing row return an error
+// wrapping sql.ErrNoRows.
+type Store interface {
+	UserBySub(ctx context.Context, sub string) (user, error)
+	CreateUser(ctx context.Context, sub, name string) (int, error)
+	RenameUser(ctx context.Context, userID int, name string) error
+	UserRole(ctx context.Context, userID int) (string, error)
+	SetUserRole(ctx context.Context, userID int, role string) error
+	RestrictUser(ctx context.Context, moderatorID *int, userID int, until *time.Time, reason string) error
+	LiftRestrictions(ctx context.Context, moderatorID *int, userID int, reason string) error
+
+	StorageQuota(ctx context.Context, userID int) (sql.NullInt64, error)
+	SetStorageQuota(ctx context.Context, userID int, quota *int64) error
+	StorageUsage(ctx context.Context, userID int) (int64, int, error)
+	ImageSizes(ctx context.Context) (map[string]int64, error)
+	SetImageSize(ctx context.Context, path string, size int64) error
+	ImageExists(ctx context.Context, path string) (bool, error)
+
+	CreatePost(ctx context.Context, userID int, p post, notify bool) (int64, []string, []mention, error)
+	UpdatePost(ctx context.Context, authorID int, postID int64, text string) ([]string, []mention, error)
+	PostOwner(ctx context.Context, postID int64) (int, error)
+	DeletePost(ctx context.Context, postID int64) error
+	Posts(ctx context.Context, postIDs []int) ([]post, error)
+
+	AddImage(ctx context.Context, ownerID int, postID int64, path string, size int, quota int64) error
+	Images(ctx context.Context, postIDs []int) (map[int][]string, error)
+
+	Like(ctx context.Context, userID int, postID int64) error
+	Unlike(ctx context.Context, userID int, postID int64) error
+	Likes(ctx context.Context, postIDs []int) (map[int][]like, error)
+
+	CreateComment(ctx context.Context, userID int, postID int64, text string) (int64, []string, []mention, error)
+	UpdateComment(ctx context.Context, authorID int, commentID int64, text string) ([]string, []mention, error)
+	CommentOwner(ctx context.Context, commentID int64) (int, error)
+	DeleteComment(ctx context.Context, commentID int64) error
+	Comments(ctx context.Context, postIDs []int) (map[int][]comment, error)
+
+	UserAlbums(ctx context.Context, userID int, pg page) ([]cursor, error)
+	Albums(ctx context.Context, albumIDs []int) ([]album, error)
+	AlbumMember(ctx context.Context, albumID int64, userID int) (int, bool, error)
+	CreateAlbum(ctx context.Context, userID int, a album) (int64, error)
+	UpdateAlbum(ctx context.Context, albumID int64, a album) error
+	DeleteAlbum(ctx context.Context, albumID int64) error
+	AddAlbumPost(ctx context.Context, albumID, postID int64) error
+	RemoveAlbumPost(ctx context.Context, albumID, postID int64) error
+	Collaborators(ctx context.Context, albumIDs []int) (map[int][]collaborator, error)
+	AddCollaborator(ctx context.Context, albumID, userID int64) error
+	RemoveCollaborator(ctx context.Context, albumID, userID int64) error
+
+	TargetExists(ctx context.Context, targetType string, targetID int) (bool, error)
+	CreateReport(ctx context.Context, rep report) (int64, error)
+	Report(ctx context.Context, reportID int64) (report, error)
+	Reports(ctx context.Context, status string, from time.Time, limit uint64) ([]report, error)
+	ResolveReport(ctx context.Context, moderatorID int, rep report, action, note string) error
+	ModerationLog(ctx context.Context, from time.Time, limit uint64) ([]moderationEntry, error)
+
+	CreateExport(ctx context.Context, userID int) (export, bool, error)
+	Export(ctx context.Context, userID int, exportID int64) (export, error)
+	CompleteExport(ctx context.Context, exportID int, status, message string) error
+	FailPendingExports(ctx context.Context) error
+	ExpiredExports(ctx context.Context, before time.Time) ([]int, error)
+	DeleteExport(ctx context.Context, exportID int) error
+	TakeoutProfile(ctx context.Context, userID int) (takeoutProfile, error)
+	TakeoutPosts(ctx context.Context, userID int) ([]post, error)
+	TakeoutPostComments(ctx context.Context, postIDs []int) (map[int][]comment, error)
+	TakeoutComments(ctx context.Context, userID int) ([]takeoutComment, error)
+	TakeoutLikes(ctx context.Context, userID int) ([]takeoutPostLink, error)
+
+	ImportedPost(ctx context.Context, userID int, source, externalID string) (int64, error)
+	RecordImport(ctx context.Context, userID int, source, externalID string, postID int64) error
+
+	ContentVersion(ctx context.Context) (uint64, error)
+}
+
+// sqlStore is the Store of the SQL databases. The statements are shared by
+// the dialects: they are written with question mark placeholders, rewritten
+// by the connections of the drivers using another bind type, and only use
+// the syntax common to SQLite and PostgreSQL.
+type sqlStore struct {
+	writer *sqlx.DB
+	reader *sqlx.DB
+
+	// hideRestricted leaves the content of the banned and suspended users out
+	// of the lists.
+	hideRestricted bool
+}
+
+// newSQLiteStore returns the store of a SQLite database. The writes go
+// through the writer, which must be a single connection, and the reads
+// through the pool of readers.
+func newSQLiteStore(writer, reader *sqlx.DB, hideRestricted bool) *sqlStore {
+	return &sqlStore{writer: writer, reader: reader, hideRestricted: hideRestricted}
+}
+
+// newPostgresStore returns the store of a PostgreSQL database, whose pool is
+// used for both reads and writes.
+func newPostgresStore(db *sqlx.DB, hideRestricted bool) *sqlStore {
+	return &sqlStore{writer: db, reader: db, hideRestricted: hideRestricted}
+}
+
+func (s *sqlStore) UserBySub(ctx context.Context, sub string) (user, error) {
+	var u user
+	err := s.writer.GetContext(ctx, &u, `
+		select id, sub, name, role, banned_at, suspended_until
+		from users
+		where sub = ?
+	`, sub)
+	if err != nil {
+		return u, wrap(err, "querying user")
+	}
+	return u, nil
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, sub, name string) (int, error) {
+	id, err := insertID(ctx, s.writer, `
+		insert into users (sub, name)
+		values (?, ?)
+	`, sub, name)
+	if err != nil {
+		return 0, wrap(err, "inserting user")
+	}
+	return int(id), nil
+}
+
+func (s *sqlStore) RenameUser(ctx context.Context, userID int, name string) error {
+	_, err := s.writer.ExecContext(ctx, `
+		update users
+		set name = ?
+		where id = ?
+	`, name, userID)
+	if err != nil {
+		return wrap(err, "updating user")
+	}
+	return nil
+}
+
+func (s *sqlStore) UserRole(ctx context.Context, userID int) (string, error) {
+	var role string
+	err := s.reader.GetContext(ctx, &role, `
+		select role
+		from users
+		where id = ?
+	`, userID)
+	if err != nil {
+		return "", wrap(err, "querying user")
+	}
+	return role, nil
+}
+
+func (s *sqlStore) SetUserRole(ctx context.Context, userID int, role string) error {
+	_, err := s.writer.ExecContext(ctx, `
+		update users
+		set role = ?
+		where id = ?
+	`, role, userID)
+	if err != nil {
+		return wrap(err, "updating role")
+	}
+	return nil
+}
+
+// RestrictUser bans the user if until is nil, or suspends it until the given
+// date, and records the action in the moderation log. A nil moderator is used
+// for the actions done outside of the API.
+func (s *sqlStore) RestrictUser(ctx context.Context, moderatorID *int, userID int, until *time.Time, reason string) error {
+	action := "ban"
+	var bannedAt, suspendedUntil interface{}
+	if until == nil {
+		bannedAt = time.Now().UTC().Format(sqliteTime)
+	} else {
+		action = "suspend"
+		suspendedUntil = until.UTC().Format(sqliteTime)
+	}
+
+	return s.moderateUser(ctx, moderatorID, userID, action, reason, `
+		update users
+		set banned_at = ?, suspended_until = ?, ban_reason = ?
+		where id = ?
+	`, bannedAt, suspendedUntil, reason, userID)
+}
+
+// LiftRestrictions clears the ban or suspension of a user, and records the
+// action in the moderation log.
+func (s *sqlStore) LiftRestrictions(ctx context.Context, moderatorID *int, userID int, reason string) error {
+	return s.moderateUser(ctx, moderatorID, userID, "unban", reason, `
+		update users
+		set banned_at = null, suspended_until = null, ban_reason = null
+		where id = ?
+	`, userID)
+}
+
+// moderateUser updates a user with the query, and records the action in the
+// moderation log in the same transaction.
+func (s *sqlStore) moderateUser(ctx context.Context, moderatorID *int, userID int, action, reason, query string, args ...interface{}) error {
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return wrap(err, "updating user")
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return wrap(sql.ErrNoRows, "updating user")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into moderation_log (moderator_id, action, target_type, target_id, note)
+		values (?, ?, ?, ?, ?)
+	`, moderatorID, action, targetUser, userID, reason)
+	if err != nil {
+		return wrap(err, "logging moderation action")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return wrap(err, "committing transaction")
+	}
+	return nil
+}
+
+// StorageQuota returns the quota of the user, which is null if the default
+// applies.
+func (s *sqlStore) StorageQuota(ctx context.Context, userID int) (sql.NullInt64, error) {
+	var quota sql.NullInt64
+	err := s.reader.GetContext(ctx, &quota, `
+		select storage_quota
+		from users
+		where id = ?
+	`, userID)
+	if err != nil {
+		return quota, wrap(err, "querying quota")
+	}
+	return quota, nil
+}
+
+// SetStorageQuota sets the quota of the user, or the default one if nil.
+func (s *sqlStore) SetStorageQuota(ctx context.Context, userID int, quota *int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		update users
+		set storage_quota = ?
+		where id = ?
+	`, quota, userID)
+	if err != nil {
+		return wrap(err, "updating quota")
+	}
+	return nil
+}
+
+// StorageUsage returns the number of bytes and of images stored by a user.
+func (s *sqlStore) StorageUsage(ctx context.Context, userID int) (int64, int, error) {
+	return storageUsage(ctx, s.reader, userID)
+}
+
+// ImageSizes returns the recorded size of the stored images, by path.
+func (s *sqlStore) ImageSizes(ctx context.Context) (map[string]int64, error) {
+	var rows []struct {
+		Path string `db:"path"`
+		Size int64  `db:"size"`
+	}
+	err := s.reader.SelectContext(ctx, &rows, `
+		select distinct path, size
+		from images
+	`)
+	if err != nil {
+		return nil, wrap(err, "querying images")
+	}
+
+	var sizes = make(map[string]int64)
+	for _, image := range rows {
+		sizes[image.Path] = image.Size
+	}
+	return sizes, nil
+}
+
+// SetImageSize records the size of an image, in every post using it.
+func (s *sqlStore) SetImageSize(ctx context.Context, path string, size int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		update images
+		set size = ?
+		where path = ?
+	`, size, path)
+	if err != nil {
+		return wrap(err, "updating %s", path)
+	}
+	return nil
+}
+
+// ImageExists checks if an image of the given path is used by a post.
+func (s *sqlStore) ImageExists(ctx context.Context, path string) (bool, error) {
+	var count int
+	err := s.reader.GetContext(ctx, &count, `
+		select count(*)
+		from images
+		where path = ?
+	`, path)
+	if err != nil {
+		return false, wrap(err, "querying image")
+	}
+	return count > 0, nil
+}
+
+// CreatePost inserts the post and indexes its entities, and returns them.
+// Posts without a creation date are created at the current date. The
+// mentioned users are only notified if notify is set.
+func (s *sqlStore) CreatePost(ctx context.Context, userID int, p post, notify bool) (int64, []string, []mention, error) {
+	var createdAt interface{}
+	if !p.CreatedAt.IsZero() {
+		createdAt = p.CreatedAt.UTC().Format(sqliteTime)
+	}
+
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, nil, nil, wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	id, err := insertID(ctx, tx, `
+		insert into posts (user_id, text, latitude, longitude, place, created_at)
+		values (?, ?, ?, ?, ?, coalesce(?, current_timestamp))
+	`, userID, p.Text, p.Latitude, p.Longitude, p.Place, createdAt)
+	if err != nil {
+		return 0, nil, nil, wrap(err, "inserting post")
+	}
+
+	tags, mentions, err := indexEntities(ctx, tx, userID, int(id), 0, p.Text, notify)
+	if err != nil {
+		return 0, nil, nil, wrap(err, "indexing post entities")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, nil, wrap(err, "committing transaction")
+	}
+	return id, tags, mentions, nil
+}
+
+// UpdatePost replaces the text of the post and indexes its entities again,
+// and returns them. Only the users mentioned for the first time are notified.
+func (s *sqlStore) UpdatePost(ctx context.Context, authorID int, postID int64, text string) ([]string, []mention, error) {
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, nil, wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		update posts
+		set text = ?
+		where id = ?
+	`, text, postID)
+	if err != nil {
+		return nil, nil, wrap(err, "updating post")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, nil, wrap(err, "counting updated posts")
+	}
+	if n == 0 {
+		return nil, nil, wrap(sql.ErrNoRows, "updating post")
+	}
+
+	tags, mentions, err := indexEntities(ctx, tx, authorID, int(postID), 0, text, true)
+	if err != nil {
+		return nil, nil, wrap(err, "indexing post entities")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, wrap(err, "committing transaction")
+	}
+	return tags, mentions, nil
+}
+
+func (s *sqlStore) PostOwner(ctx context.Context, postID int64) (int, error) {
+	var userID int
+	err := s.writer.GetContext(ctx, &userID, `
+		select user_id
+		from posts
+		where id = ?
+	`, postID)
+	if err != nil {
+		return 0, wrap(err, "finding post")
+	}
+	return userID, nil
+}
+
+func (s *sqlStore) DeletePost(ctx context.Context, postID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		delete from posts
+		where id = ?
+	`, postID)
+	if err != nil {
+		return wrap(err, "deleting post")
+	}
+	return nil
+}
+
+// Posts retrieves the visible posts for the given IDs, in reverse
+// chronological order.
+func (s *sqlStore) Posts(ctx context.Context, postIDs []int) ([]post, error) {
+	query, args, err := sqlx.In(`
+		select p.id, u.id as user_id, u.name as user_name, p.text, p.created_at,
+			p.latitude, p.longitude, coalesce(p.place, '') as place
+		from posts as p
+		left join users as u on p.user_id = u.id
+		where p.id in (?)
+		and p.hidden_at is null
+		order by p.created_at desc, p.id desc
+	`, postIDs)
+	if err != nil {
+		return nil, wrap(err, "building posts query")
+	}
+
+	var posts []post
+	err = s.reader.SelectContext(ctx, &posts, query, args...)
+	if err != nil {
+		return nil, wrap(err, "querying posts")
+	}
+	return posts, nil
+}
+
+// AddImage records an image of a post, within the quota of the owner of the
+// post, or without limit if the quota is 0. Adding the same image twice to a
+// post does nothing.
+func (s *sqlStore) AddImage(ctx context.Context, ownerID int, postID int64, path string, size int, quota int64) error {
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	if quota != 0 {
+		// Updating the owner locks its row, so the concurrent uploads of
+		// the owner wait for this one before reading the usage.
+		_, err = tx.ExecContext(ctx, `
+			update users
+			set id = id
+			where id = ?
+		`, ownerID)
+		if err != nil {
+			return wrap(err, "locking owner")
+		}
+
+		err = checkQuota(ctx, tx, ownerID, path, size, quota)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into images (post_id, path, size)
+		values (?, ?, ?)
+		on conflict do nothing
+	`, postID, path, size)
+	if err != nil {
+		return wrap(err, "inserting image")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return wrap(err, "committing transaction")
+	}
+	return nil
+}
+
+// storageUsage returns the number of bytes and of images stored by a user.
+// Each image is counted once per user, however many of their posts it is
+// used in, and regardless of whether other users posted it too: nobody pays
+// for the images of the others, nor gets theirs for free.
+func storageUsage(ctx context.Context, q sqlx.QueryerContext, userID int) (int64, int, error) {
+	var usage struct {
+		Bytes  int64 `db:"bytes"`
+		Images int   `db:"images"`
+	}
+	err := sqlx.GetContext(ctx, q, &usage, `
+		select coalesce(sum(size), 0) as bytes, count(*) as images
+		from (
+			select distinct i.path, i.size
+			from images as i
+			join posts as p on i.post_id = p.id
+			where p.user_id = ?
+		) as distinct_images
+	`, userID)
+	if err != nil {
+		return 0, 0, wrap(err, "querying usage")
+	}
+	return usage.Bytes, usage.Images, nil
+}
+
+// checkQuota ensures the user can store the image of the given path and size
+// within the quota. It is meant to run in the transaction inserting the image,
+// once the row of the user is locked, so concurrent uploads can't exceed the
+// quota together.
+func checkQuota(ctx context.Context, tx *sqlx.Tx, userID int, path string, size int, quota int64) error {
+	// The images the user already stored don't cost anything more.
+	var count int
+	err := tx.GetContext(ctx, &count, `
+		select count(*)
+		from images as i
+		join posts as p on i.post_id = p.id
+		where p.user_id = ?
+		and i.path = ?
+	`, userID, path)
+	if err != nil {
+		return wrap(err, "querying image")
+	}
+	if count != 0 {
+		return nil
+	}
+
+	used, _, err := storageUsage(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if used+int64(size) > quota {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// Images retrieves the images of the posts, by post. The path is prefixed
+// with the images endpoint so the frontend has nothing to do to load the
+// image except prefixing it with the API base URL.
+func (s *sqlStore) Images(ctx context.Context, postIDs []int) (map[int][]string, error) {
+	query, args, err := sqlx.In(`
+		select post_id, path
+		from images
+		where post_id in (?)
+	`, postIDs)
+	if err != nil {
+		return nil, wrap(err, "building images query")
+	}
+
+	var rows []struct {
+		PostID int    `db:"post_id"`
+		Path   string `db:"path"`
+	}
+	err = s.reader.SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, wrap(err, "querying images")
+	}
+
+	var images = make(map[int][]string)
+	for _, image := range rows {
+		images[image.PostID] = append(images[image.PostID], filepath.Join("/images/", image.Path))
+	}
+	return images, nil
+}
+
+// Like records the like of a post by a user. Liking a post twice does
+// nothing.
+func (s *sqlStore) Like(ctx context.Context, userID int, postID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		insert into likes (user_id, post_id)
+		values (?, ?)
+		on conflict do nothing
+	`, userID, postID)
+	if err != nil {
+		return wrap(err, "inserting like")
+	}
+	return nil
+}
+
+func (s *sqlStore) Unlike(ctx context.Context, userID int, postID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		delete from likes
+		where user_id = ?
+		and post_id = ?
+	`, userID, postID)
+	if err != nil {
+		return wrap(err, "removing like")
+	}
+	return nil
+}
+
+// Likes retrieves the likes of the posts, by post.
+func (s *sqlStore) Likes(ctx context.Context, postIDs []int) (map[int][]like, error) {
+	query, args, err := sqlx.In(`
+		select l.post_id, u.id as user_id, u.name as user_name
+		from likes as l
+		left join users as u on l.user_id = u.id
+		where l.post_id in (?)
+	`, postIDs)
+	if err != nil {
+		return nil, wrap(err, "building likes query")
+	}
+
+	var rows []like
+	err = s.reader.SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, wrap(err, "querying likes")
+	}
+
+	var likes = make(map[int][]like)
+	for _, l := range rows {
+		likes[l.PostID] = append(likes[l.PostID], l)
+	}
+	return likes, nil
+}
+
+// CreateComment inserts the comment and indexes its entities, and returns
+// them.
+func (s *sqlStore) CreateComment(ctx context.Context, userID int, postID int64, text string) (int64, []string, []mention, error) {
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, nil, nil, wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	id, err := insertID(ctx, tx, `
+		insert into comments (user_id, post_id, text)
+		values (?, ?, ?)
+	`, userID, postID, text)
+	if err != nil {
+		return 0, nil, nil, wrap(err, "inserting comment")
+	}
+
+	tags, mentions, err := indexEntities(ctx, tx, userID, int(postID), int(id), text, true)
+	if err != nil {
+		return 0, nil, nil, wrap(err, "indexing comment entities")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, nil, wrap(err, "committing transaction")
+	}
+	return id, tags, mentions, nil
+}
+
+// UpdateComment replaces the text of the comment and indexes its entities
+// again, and returns them. Only the users mentioned for the first time are
+// notified.
+func (s *sqlStore) UpdateComment(ctx context.Context, authorID int, commentID int64, text string) ([]string, []mention, error) {
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, nil, wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		update comments
+		set text = ?
+		where id = ?
+	`, text, commentID)
+	if err != nil {
+		return nil, nil, wrap(err, "updating comment")
+	}
+
+	var postID int
+	err = tx.GetContext(ctx, &postID, `
+		select post_id
+		from comments
+		where id = ?
+	`, commentID)
+	if err != nil {
+		return nil, nil, wrap(err, "finding comment")
+	}
+
+	tags, mentions, err := indexEntities(ctx, tx, authorID, postID, int(commentID), text, true)
+	if err != nil {
+		return nil, nil, wrap(err, "indexing comment entities")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, wrap(err, "committing transaction")
+	}
+	return tags, mentions, nil
+}
+
+func (s *sqlStore) CommentOwner(ctx context.Context, commentID int64) (int, error) {
+	var userID int
+	err := s.writer.GetContext(ctx, &userID, `
+		select user_id
+		from comments
+		where id = ?
+	`, commentID)
+	if err != nil {
+		return 0, wrap(err, "finding comment")
+	}
+	return userID, nil
+}
+
+func (s *sqlStore) DeleteComment(ctx context.Context, commentID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		delete from comments
+		where id = ?
+	`, commentID)
+	if err != nil {
+		return wrap(err, "deleting comment")
+	}
+	return nil
+}
+
+// Comments retrieves the visible comments of the posts, by post.
+func (s *sqlStore) Comments(ctx context.Context, postIDs []int) (map[int][]comment, error) {
+	query, args, err := sqlx.In(fmt.Sprintf(`
+		select c.id, c.post_id, u.id as user_id, u.name as user_name, c.text, c.created_at
+		from comments as c
+		left join users as u on c.user_id = u.id
+		where c.post_id in (?)
+		and c.hidden_at is null
+		%s
+	`, restrictedFilter(s.hideRestricted, "c.user_id")), postIDs)
+	if err != nil {
+		return nil, wrap(err, "building comments query")
+	}
+
+	var rows []comment
+	err = s.reader.SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, wrap(err, "querying comments")
+	}
+
+	var comments = make(map[int][]comment)
+	for _, c := range rows {
+		comments[c.PostID] = append(comments[c.PostID], c)
+	}
+	return comments, nil
+}
+
+// UserAlbums returns the page of the albums the user owns or collaborates on,
+// with one more album than the page holds if there are more.
+func (s *sqlStore) UserAlbums(ctx context.Context, userID int, pg page) ([]cursor, error) {
+	conditions, args, order := pg.conditions("")
+	var rows []cursor
+	err := s.reader.SelectContext(ctx, &rows, fmt.Sprintf(`
+		select id, created_at
+		from albums
+		where (user_id = ? or id in (
+			select album_id
+			from album_collaborators
+			where user_id = ?
+		))
+		%s
+		order by created_at %s, id %s
+		limit ?
+	`, conditions, order, order), append(append([]interface{}{userID, userID}, args...), pg.limit+1)...)
+	if err != nil {
+		return nil, wrap(err, "querying albums")
+	}
+	return rows, nil
+}
+
+// Albums retrieves the albums for the given IDs, in reverse chronological
+// order, without their collaborators.
+func (s *sqlStore) Albums(ctx context.Context, albumIDs []int) ([]album, error) {
+	query, args, err := sqlx.In(`
+		select a.id, u.id as user_id, u.name as user_name, a.title, a.description, coalesce(a.cover, '') as cover, a.created_at
+		from albums as a
+		left join users as u on a.user_id = u.id
+		where a.id in (?)
+		order by a.created_at desc, a.id desc
+	`, albumIDs)
+	if err != nil {
+		return nil, wrap(err, "building albums query")
+	}
+
+	var albums []album
+	err = s.reader.SelectContext(ctx, &albums, query, args...)
+	if err != nil {
+		return nil, wrap(err, "querying albums")
+	}
+	return albums, nil
+}
+
+// AlbumMember returns the owner of the album, and whether the user is one of
+// its collaborators.
+func (s *sqlStore) AlbumMember(ctx context.Context, albumID int64, userID int) (int, bool, error) {
+	var ownerID int
+	err := s.reader.GetContext(ctx, &ownerID, `
+		select user_id
+		from albums
+		where id = ?
+	`, albumID)
+	if err != nil {
+		return 0, false, wrap(err, "querying album")
+	}
+
+	var count int
+	err = s.reader.GetContext(ctx, &count, `
+		select count(*)
+		from album_collaborators
+		where album_id = ?
+		and user_id = ?
+	`, albumID, userID)
+	if err != nil {
+		return 0, false, wrap(err, "querying collaborator")
+	}
+	return ownerID, count > 0, nil
+}
+
+func (s *sqlStore) CreateAlbum(ctx context.Context, userID int, a album) (int64, error) {
+	id, err := insertID(ctx, s.writer, `
+		insert into albums (user_id, title, description, cover)
+		values (?, ?, ?, ?)
+	`, userID, a.Title, a.Description, a.Cover)
+	if err != nil {
+		return 0, wrap(err, "inserting album")
+	}
+	return id, nil
+}
+
+func (s *sqlStore) UpdateAlbum(ctx context.Context, albumID int64, a album) error {
+	_, err := s.writer.ExecContext(ctx, `
+		update albums
+		set title = ?, description = ?, cover = ?
+		where id = ?
+	`, a.Title, a.Description, a.Cover, albumID)
+	if err != nil {
+		return wrap(err, "updating album")
+	}
+	return nil
+}
+
+// DeleteAlbum removes the album, but not its posts.
+func (s *sqlStore) DeleteAlbum(ctx context.Context, albumID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		delete from albums
+		where id = ?
+	`, albumID)
+	if err != nil {
+		return wrap(err, "deleting album")
+	}
+	return nil
+}
+
+// AddAlbumPost adds a post to an album. Adding a post twice does nothing.
+func (s *sqlStore) AddAlbumPost(ctx context.Context, albumID, postID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		insert into album_posts (album_id, post_id)
+		values (?, ?)
+		on conflict do nothing
+	`, albumID, postID)
+	if err != nil {
+		return wrap(err, "inserting album post")
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveAlbumPost(ctx context.Context, albumID, postID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		delete from album_posts
+		where album_id = ?
+		and post_id = ?
+	`, albumID, postID)
+	if err != nil {
+		return wrap(err, "removing album post")
+	}
+	return nil
+}
+
+// Collaborators retrieves the collaborators of the albums, by album.
+func (s *sqlStore) Collaborators(ctx context.Context, albumIDs []int) (map[int][]collaborator, error) {
+	query, args, err := sqlx.In(`
+		select c.album_id, u.id as user_id, u.name as user_name
+		from album_collaborators as c
+		left join users as u on c.user_id = u.id
+		where c.album_id in (?)
+	`, albumIDs)
+	if err != nil {
+		return nil, wrap(err, "building collaborators query")
+	}
+
+	var rows []collaborator
+	err = s.reader.SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, wrap(err, "querying collaborators")
+	}
+
+	var collaborators = make(map[int][]collaborator)
+	for _, c := range rows {
+		collaborators[c.AlbumID] = append(collaborators[c.AlbumID], c)
+	}
+	return collaborators, nil
+}
+
+// AddCollaborator shares an album with a user. Adding a collaborator twice
+// does nothing.
+func (s *sqlStore) AddCollaborator(ctx context.Context, albumID, userID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		insert into album_collaborators (album_id, user_id)
+		values (?, ?)
+		on conflict do nothing
+	`, albumID, userID)
+	if err != nil {
+		return wrap(err, "inserting collaborator")
+	}
+	return nil
+}
+
+func (s *sqlStore) RemoveCollaborator(ctx context.Context, albumID, userID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		delete from album_collaborators
+		where album_id = ?
+		and user_id = ?
+	`, albumID, userID)
+	if err != nil {
+		return wrap(err, "removing collaborator")
+	}
+	return nil
+}
+
+// TargetExists checks if the reportable content of the given type exists.
+func (s *sqlStore) TargetExists(ctx context.Context, targetType string, targetID int) (bool, error) {
+	var count int
+	err := s.reader.GetContext(ctx, &count, fmt.Sprintf(`
+		select count(*)
+		from %s
+		where id = ?
+	`, targetTables[targetType]), targetID)
+	if err != nil {
+		return false, wrap(err, "querying %s", targetType)
+	}
+	return count > 0, nil
+}
+
+func (s *sqlStore) CreateReport(ctx context.Context, rep report) (int64, error) {
+	id, err := insertID(ctx, s.writer, `
+		insert into reports (reporter_id, target_type, target_id, reason)
+		values (?, ?, ?, ?)
+	`, rep.ReporterID, rep.TargetType, rep.TargetID, rep.Reason)
+	if err != nil {
+		return 0, wrap(err, "inserting report")
+	}
+	return id, nil
+}
+
+func (s *sqlStore) Report(ctx context.Context, reportID int64) (report, error) {
+	var rep report
+	err := s.reader.GetContext(ctx, &rep, `
+		select id, reporter_id, target_type, target_id, reason, status, created_at, resolved_by, resolved_at
+		from reports
+		where id = ?
+	`, reportID)
+	if err != nil {
+		return rep, wrap(err, "querying report")
+	}
+	return rep, nil
+}
+
+// Reports returns the reports of the given status created before the date,
+// most recent first.
+func (s *sqlStore) Reports(ctx context.Context, status string, from time.Time, limit uint64) ([]report, error) {
+	var reports = []report{}
+	err := s.reader.SelectContext(ctx, &reports, `
+		select id, reporter_id, target_type, target_id, reason, status, created_at, resolved_by, resolved_at
+		from reports
+		where status = ?
+		and created_at < ?
+		order by created_at desc
+		limit ?
+	`, status, from, limit)
+	if err != nil {
+		return nil, wrap(err, "querying reports")
+	}
+	return reports, nil
+}
+
+// ResolveReport applies the moderation action on the target of the report,
+// settles every open report about the same target, and records the action in
+// the moderation log. The users are deleted beforehand, with their account.
+func (s *sqlStore) ResolveReport(ctx context.Context, moderatorID int, rep report, action, note string) error {
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	err = moderate(ctx, tx, action, rep.TargetType, rep.TargetID)
+	if err != nil {
+		return wrap(err, "moderating content")
+	}
+
+	status := "resolved"
+	if action == actionDismiss {
+		status = "dismissed"
+	}
+	_, err = tx.ExecContext(ctx, `
+		update reports
+		set status = ?, resolved_by = ?, resolved_at = current_timestamp
+		where target_type = ?
+		and target_id = ?
+		and status = 'open'
+	`, status, moderatorID, rep.TargetType, rep.TargetID)
+	if err != nil {
+		return wrap(err, "updating reports")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		insert into moderation_log (moderator_id, report_id, action, target_type, target_id, note)
+		values (?, ?, ?, ?, ?, ?)
+	`, moderatorID, rep.ID, action, rep.TargetType, rep.TargetID, note)
+	if err != nil {
+		return wrap(err, "logging moderation action")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return wrap(err, "committing transaction")
+	}
+	return nil
+}
+
+// moderate applies a moderation action to the reported content. Hiding a user
+// hides everything they posted.
+func moderate(ctx context.Context, tx *sqlx.Tx, action, targetType string, targetID int) error {
+	var queries []string
+	switch {
+	case action == actionDismiss:
+		return nil
+	case action == actionDelete && targetType == targetUser:
+		return nil
+	case action == actionHide && targetType == targetUser:
+		queries = []string{
+			`update posts set hidden_at = current_timestamp where user_id = ? and hidden_at is null`,
+			`update comments set hidden_at = current_timestamp where user_id = ? and hidden_at is null`,
+		}
+	case action == actionHide:
+		queries = []string{
+			fmt.Sprintf(`update %s set hidden_at = current_timestamp where id = ? and hidden_at is null`, targetTables[targetType]),
+		}
+	case action == actionDelete:
+		queries = []string{
+			fmt.Sprintf(`delete from %s where id = ?`, targetTables[targetType]),
+		}
+	}
+
+	for _, query := range queries {
+		_, err := tx.ExecContext(ctx, query, targetID)
+		if err != nil {
+			return wrap(err, "applying %s on %s", action, targetType)
+		}
+	}
+	return nil
+}
+
+// ModerationLog returns the moderation actions done before the date, most
+// recent first.
+func (s *sqlStore) ModerationLog(ctx context.Context, from time.Time, limit uint64) ([]moderationEntry, error) {
+	var entries = []moderationEntry{}
+	err := s.reader.SelectContext(ctx, &entries, `
+		select id, moderator_id, report_id, action, target_type, target_id, note, created_at
+		from moderation_log
+		where created_at < ?
+		order by created_at desc
+		limit ?
+	`, from, limit)
+	if err != nil {
+		return nil, wrap(err, "querying moderation log")
+	}
+	return entries, nil
+}
+
+// CreateExport creates a pending export for the user, and returns it along
+// true. Only one export is built at a time for a user, so the pending one is
+// returned along false if there is one.
+func (s *sqlStore) CreateExport(ctx context.Context, userID int) (export, bool, error) {
+	var e export
+	tx, err := s.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return e, false, wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	// Updating the user first locks its row, so the concurrent requests of
+	// the user wait for this one to be committed before looking for a
+	// pending export.
+	_, err = tx.ExecContext(ctx, `
+		update users
+		set id = id
+		where id = ?
+	`, userID)
+	if err != nil {
+		return e, false, wrap(err, "locking user")
+	}
+
+	err = tx.GetContext(ctx, &e, `
+		select id, user_id, status, error, created_at, completed_at
+		from exports
+		where user_id = ?
+		and status = ?
+	`, userID, exportPending)
+	if err == nil {
+		return e, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return e, false, wrap(err, "querying exports")
+	}
+
+	id, err := insertID(ctx, tx, `
+		insert into exports (user_id, status)
+		values (?, ?)
+	`, userID, exportPending)
+	if err != nil {
+		return e, false, wrap(err, "inserting export")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return e, false, wrap(err, "committing transaction")
+	}
+
+	return export{
+		ID:        int(id),
+		UserID:    userID,
+		Status:    exportPending,
+		CreatedAt: time.Now().UTC(),
+	}, true, nil
+}
+
+// Export returns an export of the user.
+func (s *sqlStore) Export(ctx context.Context, userID int, exportID int64) (export, error) {
+	var e export
+	err := s.reader.GetContext(ctx, &e, `
+		select id, user_id, status, error, created_at, completed_at
+		from exports
+		where id = ?
+		and user_id = ?
+	`, exportID, userID)
+	if err != nil {
+		return e, wrap(err, "querying export")
+	}
+	return e, nil
+}
+
+// CompleteExport records the outcome of an export.
+func (s *sqlStore) CompleteExport(ctx context.Context, exportID int, status, message string) error {
+	_, err := s.writer.ExecContext(ctx, `
+		update exports
+		set status = ?, error = ?, completed_at = current_timestamp
+		where id = ?
+	`, status, message, exportID)
+	if err != nil {
+		return wrap(err, "updating export")
+	}
+	return nil
+}
+
+// FailPendingExports marks the pending exports as failed.
+func (s *sqlStore) FailPendingExports(ctx context.Context) error {
+	_, err := s.writer.ExecContext(ctx, `
+		update exports
+		set status = ?, error = 'interrupted', completed_at = current_timestamp
+		where status = ?
+	`, exportFailed, exportPending)
+	if err != nil {
+		return wrap(err, "updating exports")
+	}
+	return nil
+}
+
+// ExpiredExports returns the exports completed before the date.
+func (s *sqlStore) ExpiredExports(ctx context.Context, before time.Time) ([]int, error) {
+	var exportIDs []int
+	err := s.reader.SelectContext(ctx, &exportIDs, `
+		select id
+		from exports
+		where completed_at < ?
+	`, before.UTC().Format(sqliteTime))
+	if err != nil {
+		return nil, wrap(err, "querying expired exports")
+	}
+	return exportIDs, nil
+}
+
+func (s *sqlStore) DeleteExport(ctx context.Context, exportID int) error {
+	_, err := s.writer.ExecContext(ctx, `
+		delete from exports
+		where id = ?
+	`, exportID)
+	if err != nil {
+		return wrap(err, "deleting export %d", exportID)
+	}
+	return nil
+}
+
+func (s *sqlStore) TakeoutProfile(ctx context.Context, userID int) (takeoutProfile, error) {
+	var p takeoutProfile
+	err := s.reader.GetContext(ctx, &p, `
+		select id, sub, name, role
+		from users
+		where id = ?
+	`, userID)
+	if err != nil {
+		return p, wrap(err, "querying profile")
+	}
+	return p, nil
+}
+
+// TakeoutPosts returns all the posts of the user, in reverse chronological
+// order. Unlike Posts, it ignores the moderation, as the hidden posts are
+// part of the user's data too.
+func (s *sqlStore) TakeoutPosts(ctx context.Context, userID int) ([]post, error) {
+	var posts []post
+	err := s.reader.SelectContext(ctx, &posts, `
+		select p.id, u.id as user_id, u.name as user_name, p.text, p.created_at,
+			p.latitude, p.longitude, coalesce(p.place, '') as place
+		from posts as p
+		left join users as u on p.user_id = u.id
+		where p.user_id = ?
+		order by p.created_at desc, p.id desc
+	`, userID)
+	if err != nil {
+		return nil, wrap(err, "querying posts")
+	}
+	return posts, nil
+}
+
+// TakeoutPostComments retrieves all the comments of the posts, by post. Unlike
+// Comments, it ignores the moderation.
+func (s *sqlStore) TakeoutPostComments(ctx context.Context, postIDs []int) (map[int][]comment, error) {
+	query, args, err := sqlx.In(`
+		select c.id, c.post_id, u.id as user_id, u.name as user_name, c.text, c.created_at
+		from comments as c
+		left join users as u on c.user_id = u.id
+		where c.post_id in (?)
+		order by c.created_at, c.id
+	`, postIDs)
+	if err != nil {
+		return nil, wrap(err, "building comments query")
+	}
+
+	var rows []comment
+	err = s.reader.SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, wrap(err, "querying comments")
+	}
+
+	var comments = make(map[int][]comment)
+	for _, c := range rows {
+		comments[c.PostID] = append(comments[c.PostID], c)
+	}
+	return comments, nil
+}
+
+// TakeoutComments returns the comments of the user, on any post.
+func (s *sqlStore) TakeoutComments(ctx context.Context, userID int) ([]takeoutComment, error) {
+	var comments []takeoutComment
+	err := s.reader.SelectContext(ctx, &comments, `
+		select id, post_id, text, created_at
+		from comments
+		where user_id = ?
+		order by created_at desc
+	`, userID)
+	if err != nil {
+		return nil, wrap(err, "querying comments")
+	}
+	return comments, nil
+}
+
+// TakeoutLikes returns the posts liked by the user.
+func (s *sqlStore) TakeoutLikes(ctx context.Context, userID int) ([]takeoutPostLink, error) {
+	var likes []takeoutPostLink
+	err := s.reader.SelectContext(ctx, &likes, `
+		select l.post_id, u.name as user_name
+		from likes as l
+		join posts as p on l.post_id = p.id
+		join users as u on p.user_id = u.id
+		where l.user_id = ?
+		order by l.post_id desc
+	`, userID)
+	if err != nil {
+		return nil, wrap(err, "querying likes")
+	}
+	return likes, nil
+}
+
+// ImportedPost returns the post imported for an item of an archive.
+func (s *sqlStore) ImportedPost(ctx context.Context, userID int, source, externalID string) (int64, error) {
+	var postID int64
+	err := s.reader.GetContext(ctx, &postID, `
+		select post_id
+		from imports
+		where user_id = ?
+		and source = ?
+		and external_id = ?
+	`, userID, source, externalID)
+	if err != nil {
+		return 0, wrap(err, "querying imports")
+	}
+	return postID, nil
+}
+
+// RecordImport records the post imported for an item of an archive.
+func (s *sqlStore) RecordImport(ctx context.Context, userID int, source, externalID string, postID int64) error {
+	_, err := s.writer.ExecContext(ctx, `
+		insert into imports (user_id, source, external_id, post_id)
+		values (?, ?, ?, ?)
+	`, userID, source, externalID, postID)
+	if err != nil {
+		return wrap(err, "recording import")
+	}
+	return nil
+}
+
+// ContentVersion returns the version of the content, bumped by the triggers of
+// the tables in the transactions writing them.
+func (s *sqlStore) ContentVersion(ctx context.Context) (uint64, error) {
+	var version uint64
+	err := s.reader.GetContext(ctx, &version, `
+		select version
+		from content_version
+	`)
+	if err != nil {
+		return 0, wrap(err, "querying content version")
+	}
+	return version, nil
+}
@@ -0,0 +1,864 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// storeTests are the behaviours every Store must have, whatever its database.
+var storeTests = []struct {
+	name string
+	run  func(t *testing.T, ctx context.Context, st Store)
+}{
+	{
+		name: "users",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			id := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+
+			err := st.RenameUser(ctx, id, "alicia")
+			if err != nil {
+				t.Fatalf("renaming user: %s", err)
+			}
+
+			u, err := st.UserBySub(ctx, "sub|alice")
+			if err != nil {
+				t.Fatalf("finding user: %s", err)
+			}
+			if u.ID != id || u.Name != "alicia" || u.Role != roleUser {
+				t.Errorf("got user %+v, expected %d named alicia with role %s", u, id, roleUser)
+			}
+
+			_, err = st.UserBySub(ctx, "sub|nobody")
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding missing user: got %v, expected sql.ErrNoRows", err)
+			}
+		},
+	},
+	{
+		name: "posts",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			aliceID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			bobID := mustCreateUser(t, ctx, st, "sub|bob", "bob")
+
+			createdAt := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+			latitude, longitude := 48.85, 2.35
+			firstID, _, _, err := st.CreatePost(ctx, aliceID, post{Text: "first", CreatedAt: createdAt}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+			secondID, tags, mentions, err := st.CreatePost(ctx, aliceID, post{
+				Text:      "#Ananas with @bob",
+				Latitude:  &latitude,
+				Longitude: &longitude,
+			}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+			if !reflect.DeepEqual(tags, []string{"ananas"}) {
+				t.Errorf("got tags %v, expected [ananas]", tags)
+			}
+			if len(mentions) != 1 || mentions[0].UserID != bobID || mentions[0].UserName != "bob" {
+				t.Errorf("got mentions %+v, expected bob", mentions)
+			}
+
+			ownerID, err := st.PostOwner(ctx, secondID)
+			if err != nil {
+				t.Fatalf("finding post owner: %s", err)
+			}
+			if ownerID != aliceID {
+				t.Errorf("got owner %d, expected %d", ownerID, aliceID)
+			}
+
+			posts, err := st.Posts(ctx, []int{int(firstID), int(secondID)})
+			if err != nil {
+				t.Fatalf("querying posts: %s", err)
+			}
+			if len(posts) != 2 {
+				t.Fatalf("got %d posts, expected 2", len(posts))
+			}
+			if posts[0].ID != int(secondID) || posts[1].ID != int(firstID) {
+				t.Errorf("got posts %d and %d, expected the most recent first", posts[0].ID, posts[1].ID)
+			}
+			if posts[0].UserName != "alice" || posts[0].Latitude == nil || *posts[0].Latitude != latitude {
+				t.Errorf("got post %+v, expected alice's post with its location", posts[0])
+			}
+			if !posts[1].CreatedAt.Equal(createdAt) {
+				t.Errorf("got creation date %s, expected %s", posts[1].CreatedAt, createdAt)
+			}
+
+			err = st.DeletePost(ctx, firstID)
+			if err != nil {
+				t.Fatalf("deleting post: %s", err)
+			}
+			_, err = st.PostOwner(ctx, firstID)
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding deleted post: got %v, expected sql.ErrNoRows", err)
+			}
+		},
+	},
+	{
+		name: "edits",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			aliceID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			bobID := mustCreateUser(t, ctx, st, "sub|bob", "bob")
+			mustCreateUser(t, ctx, st, "sub|carol", "carol")
+			postID, _, _, err := st.CreatePost(ctx, aliceID, post{Text: "#old with @bob"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+			commentID, _, _, err := st.CreateComment(ctx, bobID, postID, "hi")
+			if err != nil {
+				t.Fatalf("creating comment: %s", err)
+			}
+
+			// Bob is removed then mentioned again, along carol, and is only
+			// notified the first time.
+			var tags []string
+			for _, text := range []string{"#new", "#new with @bob and @carol"} {
+				tags, _, err = st.UpdatePost(ctx, aliceID, postID, text)
+				if err != nil {
+					t.Fatalf("updating post: %s", err)
+				}
+			}
+			if !reflect.DeepEqual(tags, []string{"new"}) {
+				t.Errorf("got tags %v, expected [new]", tags)
+			}
+
+			tags, mentions, err := st.UpdateComment(ctx, bobID, commentID, "#reply @alice")
+			if err != nil {
+				t.Fatalf("updating comment: %s", err)
+			}
+			if !reflect.DeepEqual(tags, []string{"reply"}) || len(mentions) != 1 || mentions[0].UserID != aliceID {
+				t.Errorf("got tags %v and mentions %+v, expected reply and alice", tags, mentions)
+			}
+
+			var notified []string
+			err = st.(*sqlStore).reader.SelectContext(ctx, &notified, `
+				select u.name
+				from notifications as n
+				left join users as u on n.user_id = u.id
+				where n.kind = 'mention'
+				order by u.name
+			`)
+			if err != nil {
+				t.Fatalf("querying notifications: %s", err)
+			}
+			if expected := []string{"alice", "bob", "carol"}; !reflect.DeepEqual(notified, expected) {
+				t.Errorf("got mentions notified to %v, expected %v", notified, expected)
+			}
+
+			_, _, err = st.UpdatePost(ctx, aliceID, postID+1, "missing")
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("updating missing post: got %v, expected sql.ErrNoRows", err)
+			}
+			_, _, err = st.UpdateComment(ctx, bobID, commentID+1, "missing")
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("updating missing comment: got %v, expected sql.ErrNoRows", err)
+			}
+		},
+	},
+	{
+		name: "images",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			userID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			postID, _, _, err := st.CreatePost(ctx, userID, post{Text: "post"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+
+			// Adding the same image twice only adds it once.
+			for i := 0; i < 2; i++ {
+				err = st.AddImage(ctx, userID, postID, "ab/cdef", 10, 0)
+				if err != nil {
+					t.Fatalf("adding image: %s", err)
+				}
+			}
+
+			// The images already stored are free, the others must fit.
+			err = st.AddImage(ctx, userID, postID, "ab/cdef", 10, 15)
+			if err != nil {
+				t.Errorf("adding stored image within quota: %s", err)
+			}
+			err = st.AddImage(ctx, userID, postID, "12/3456", 10, 15)
+			if !errors.Is(err, errQuotaExceeded) {
+				t.Errorf("adding image over quota: got %v, expected errQuotaExceeded", err)
+			}
+
+			images, err := st.Images(ctx, []int{int(postID)})
+			if err != nil {
+				t.Fatalf("querying images: %s", err)
+			}
+			if expected := []string{"/images/ab/cdef"}; !reflect.DeepEqual(images[int(postID)], expected) {
+				t.Errorf("got images %v, expected %v", images[int(postID)], expected)
+			}
+		},
+	},
+	{
+		name: "likes",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			userID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			postID, _, _, err := st.CreatePost(ctx, userID, post{Text: "post"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+
+			// Liking a post twice only likes it once.
+			for i := 0; i < 2; i++ {
+				err = st.Like(ctx, userID, postID)
+				if err != nil {
+					t.Fatalf("liking post: %s", err)
+				}
+			}
+			likes, err := st.Likes(ctx, []int{int(postID)})
+			if err != nil {
+				t.Fatalf("querying likes: %s", err)
+			}
+			if expected := []like{{PostID: int(postID), UserID: userID, UserName: "alice"}}; !reflect.DeepEqual(likes[int(postID)], expected) {
+				t.Errorf("got likes %+v, expected %+v", likes[int(postID)], expected)
+			}
+
+			err = st.Unlike(ctx, userID, postID)
+			if err != nil {
+				t.Fatalf("unliking post: %s", err)
+			}
+			likes, err = st.Likes(ctx, []int{int(postID)})
+			if err != nil {
+				t.Fatalf("querying likes: %s", err)
+			}
+			if len(likes[int(postID)]) != 0 {
+				t.Errorf("got likes %+v, expected none", likes[int(postID)])
+			}
+		},
+	},
+	{
+		name: "comments",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			aliceID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			bobID := mustCreateUser(t, ctx, st, "sub|bob", "bob")
+			postID, _, _, err := st.CreatePost(ctx, aliceID, post{Text: "post"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+
+			commentID, tags, mentions, err := st.CreateComment(ctx, bobID, postID, "#nice @alice")
+			if err != nil {
+				t.Fatalf("creating comment: %s", err)
+			}
+			if !reflect.DeepEqual(tags, []string{"nice"}) {
+				t.Errorf("got tags %v, expected [nice]", tags)
+			}
+			if len(mentions) != 1 || mentions[0].UserID != aliceID {
+				t.Errorf("got mentions %+v, expected alice", mentions)
+			}
+
+			ownerID, err := st.CommentOwner(ctx, commentID)
+			if err != nil {
+				t.Fatalf("finding comment owner: %s", err)
+			}
+			if ownerID != bobID {
+				t.Errorf("got owner %d, expected %d", ownerID, bobID)
+			}
+
+			comments, err := st.Comments(ctx, []int{int(postID)})
+			if err != nil {
+				t.Fatalf("querying comments: %s", err)
+			}
+			if c := comments[int(postID)]; len(c) != 1 || c[0].ID != int(commentID) || c[0].UserName != "bob" || c[0].Text != "#nice @alice" {
+				t.Errorf("got comments %+v, expected bob's comment", c)
+			}
+
+			err = st.DeleteComment(ctx, commentID)
+			if err != nil {
+				t.Fatalf("deleting comment: %s", err)
+			}
+			_, err = st.CommentOwner(ctx, commentID)
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding deleted comment: got %v, expected sql.ErrNoRows", err)
+			}
+		},
+	},
+	{
+		name: "restrictions",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			modID := mustCreateUser(t, ctx, st, "sub|mod", "mod")
+			userID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+
+			err := st.SetUserRole(ctx, modID, roleModerator)
+			if err != nil {
+				t.Fatalf("setting role: %s", err)
+			}
+			role, err := st.UserRole(ctx, modID)
+			if err != nil {
+				t.Fatalf("querying role: %s", err)
+			}
+			if role != roleModerator {
+				t.Errorf("got role %s, expected %s", role, roleModerator)
+			}
+
+			until := time.Now().Add(time.Hour)
+			err = st.RestrictUser(ctx, &modID, userID, &until, "spam")
+			if err != nil {
+				t.Fatalf("suspending user: %s", err)
+			}
+			u, err := st.UserBySub(ctx, "sub|alice")
+			if err != nil {
+				t.Fatalf("finding user: %s", err)
+			}
+			if u.BannedAt != nil || u.SuspendedUntil == nil {
+				t.Errorf("got user %+v, expected a suspension", u)
+			}
+
+			err = st.LiftRestrictions(ctx, nil, userID, "appeal")
+			if err != nil {
+				t.Fatalf("lifting restrictions: %s", err)
+			}
+			u, err = st.UserBySub(ctx, "sub|alice")
+			if err != nil {
+				t.Fatalf("finding user: %s", err)
+			}
+			if u.BannedAt != nil || u.SuspendedUntil != nil {
+				t.Errorf("got user %+v, expected no restriction", u)
+			}
+
+			err = st.RestrictUser(ctx, &modID, userID+1, nil, "spam")
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("banning missing user: got %v, expected sql.ErrNoRows", err)
+			}
+
+			entries, err := st.ModerationLog(ctx, time.Now().Add(time.Hour), 10)
+			if err != nil {
+				t.Fatalf("querying moderation log: %s", err)
+			}
+			var actions []string
+			for _, e := range entries {
+				actions = append(actions, e.Action)
+			}
+			sort.Strings(actions)
+			if expected := []string{"suspend", "unban"}; !reflect.DeepEqual(actions, expected) {
+				t.Errorf("got actions %v, expected %v", actions, expected)
+			}
+		},
+	},
+	{
+		name: "quotas",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			userID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			postID, _, _, err := st.CreatePost(ctx, userID, post{Text: "post"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+			err = st.AddImage(ctx, userID, postID, "ab/cdef", 10, 0)
+			if err != nil {
+				t.Fatalf("adding image: %s", err)
+			}
+
+			quota, err := st.StorageQuota(ctx, userID)
+			if err != nil {
+				t.Fatalf("querying quota: %s", err)
+			}
+			if quota.Valid {
+				t.Errorf("got quota %d, expected the default", quota.Int64)
+			}
+			limit := int64(100)
+			err = st.SetStorageQuota(ctx, userID, &limit)
+			if err != nil {
+				t.Fatalf("setting quota: %s", err)
+			}
+			quota, err = st.StorageQuota(ctx, userID)
+			if err != nil {
+				t.Fatalf("querying quota: %s", err)
+			}
+			if !quota.Valid || quota.Int64 != limit {
+				t.Errorf("got quota %+v, expected %d", quota, limit)
+			}
+
+			err = st.SetImageSize(ctx, "ab/cdef", 20)
+			if err != nil {
+				t.Fatalf("setting image size: %s", err)
+			}
+			sizes, err := st.ImageSizes(ctx)
+			if err != nil {
+				t.Fatalf("querying image sizes: %s", err)
+			}
+			if expected := map[string]int64{"ab/cdef": 20}; !reflect.DeepEqual(sizes, expected) {
+				t.Errorf("got sizes %v, expected %v", sizes, expected)
+			}
+
+			used, images, err := st.StorageUsage(ctx, userID)
+			if err != nil {
+				t.Fatalf("querying usage: %s", err)
+			}
+			if used != 20 || images != 1 {
+				t.Errorf("got usage of %d bytes in %d images, expected 20 bytes in 1 image", used, images)
+			}
+
+			for path, expected := range map[string]bool{"ab/cdef": true, "12/3456": false} {
+				exists, err := st.ImageExists(ctx, path)
+				if err != nil {
+					t.Fatalf("finding image: %s", err)
+				}
+				if exists != expected {
+					t.Errorf("image %s: got %t, expected %t", path, exists, expected)
+				}
+			}
+		},
+	},
+	{
+		name: "albums",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			aliceID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			bobID := mustCreateUser(t, ctx, st, "sub|bob", "bob")
+			postID, _, _, err := st.CreatePost(ctx, aliceID, post{Text: "post"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+
+			var albumIDs []int64
+			for _, title := range []string{"first", "second"} {
+				albumID, err := st.CreateAlbum(ctx, aliceID, album{Title: title})
+				if err != nil {
+					t.Fatalf("creating album: %s", err)
+				}
+				albumIDs = append(albumIDs, albumID)
+			}
+			err = st.UpdateAlbum(ctx, albumIDs[0], album{Title: "renamed", Description: "description"})
+			if err != nil {
+				t.Fatalf("updating album: %s", err)
+			}
+
+			// Adding a post or a collaborator twice only adds it once.
+			for i := 0; i < 2; i++ {
+				err = st.AddAlbumPost(ctx, albumIDs[0], postID)
+				if err != nil {
+					t.Fatalf("adding album post: %s", err)
+				}
+				err = st.AddCollaborator(ctx, albumIDs[0], int64(bobID))
+				if err != nil {
+					t.Fatalf("adding collaborator: %s", err)
+				}
+			}
+			err = st.AddAlbumPost(ctx, albumIDs[0], postID+1)
+			if !isForeignKeyViolation(err) {
+				t.Errorf("adding missing post: got %v, expected a foreign key violation", err)
+			}
+
+			ownerID, shared, err := st.AlbumMember(ctx, albumIDs[0], bobID)
+			if err != nil {
+				t.Fatalf("finding album member: %s", err)
+			}
+			if ownerID != aliceID || !shared {
+				t.Errorf("got owner %d and collaborator %t, expected %d and true", ownerID, shared, aliceID)
+			}
+			_, _, err = st.AlbumMember(ctx, albumIDs[1]+1, bobID)
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding missing album: got %v, expected sql.ErrNoRows", err)
+			}
+
+			// Bob only sees the album shared with him.
+			rows, err := st.UserAlbums(ctx, bobID, page{limit: 10})
+			if err != nil {
+				t.Fatalf("listing albums: %s", err)
+			}
+			if len(rows) != 1 || rows[0].ID != int(albumIDs[0]) {
+				t.Errorf("got albums %+v, expected %d", rows, albumIDs[0])
+			}
+
+			albums, err := st.Albums(ctx, []int{int(albumIDs[0])})
+			if err != nil {
+				t.Fatalf("querying albums: %s", err)
+			}
+			if len(albums) != 1 || albums[0].Title != "renamed" || albums[0].Description != "description" || albums[0].UserName != "alice" {
+				t.Errorf("got albums %+v, expected the renamed one", albums)
+			}
+			collaborators, err := st.Collaborators(ctx, []int{int(albumIDs[0])})
+			if err != nil {
+				t.Fatalf("querying collaborators: %s", err)
+			}
+			if expected := []collaborator{{AlbumID: int(albumIDs[0]), UserID: bobID, UserName: "bob"}}; !reflect.DeepEqual(collaborators[int(albumIDs[0])], expected) {
+				t.Errorf("got collaborators %+v, expected %+v", collaborators[int(albumIDs[0])], expected)
+			}
+
+			err = st.RemoveCollaborator(ctx, albumIDs[0], int64(bobID))
+			if err != nil {
+				t.Fatalf("removing collaborator: %s", err)
+			}
+			err = st.RemoveAlbumPost(ctx, albumIDs[0], postID)
+			if err != nil {
+				t.Fatalf("removing album post: %s", err)
+			}
+			err = st.DeleteAlbum(ctx, albumIDs[0])
+			if err != nil {
+				t.Fatalf("deleting album: %s", err)
+			}
+			rows, err = st.UserAlbums(ctx, aliceID, page{limit: 10})
+			if err != nil {
+				t.Fatalf("listing albums: %s", err)
+			}
+			if len(rows) != 1 || rows[0].ID != int(albumIDs[1]) {
+				t.Errorf("got albums %+v, expected %d", rows, albumIDs[1])
+			}
+		},
+	},
+	{
+		name: "reports",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			aliceID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			modID := mustCreateUser(t, ctx, st, "sub|mod", "mod")
+			postID, _, _, err := st.CreatePost(ctx, aliceID, post{Text: "post"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+
+			for _, tc := range []struct {
+				targetType string
+				targetID   int
+				exists     bool
+			}{
+				{targetType: targetPost, targetID: int(postID), exists: true},
+				{targetType: targetComment, targetID: 1, exists: false},
+				{targetType: targetUser, targetID: aliceID, exists: true},
+			} {
+				exists, err := st.TargetExists(ctx, tc.targetType, tc.targetID)
+				if err != nil {
+					t.Fatalf("finding %s: %s", tc.targetType, err)
+				}
+				if exists != tc.exists {
+					t.Errorf("%s %d: got %t, expected %t", tc.targetType, tc.targetID, exists, tc.exists)
+				}
+			}
+
+			// Both reports of the post are settled by hiding it.
+			var reportIDs []int64
+			for i := 0; i < 2; i++ {
+				reportID, err := st.CreateReport(ctx, report{ReporterID: modID, TargetType: targetPost, TargetID: int(postID), Reason: "spam"})
+				if err != nil {
+					t.Fatalf("creating report: %s", err)
+				}
+				reportIDs = append(reportIDs, reportID)
+			}
+			reports, err := st.Reports(ctx, "open", time.Now().Add(time.Hour), 10)
+			if err != nil {
+				t.Fatalf("querying reports: %s", err)
+			}
+			if len(reports) != 2 {
+				t.Errorf("got reports %+v, expected 2", reports)
+			}
+
+			rep, err := st.Report(ctx, reportIDs[0])
+			if err != nil {
+				t.Fatalf("finding report: %s", err)
+			}
+			err = st.ResolveReport(ctx, modID, rep, actionHide, "hidden")
+			if err != nil {
+				t.Fatalf("resolving report: %s", err)
+			}
+
+			rep, err = st.Report(ctx, reportIDs[1])
+			if err != nil {
+				t.Fatalf("finding report: %s", err)
+			}
+			if rep.Status != "resolved" || rep.ResolvedBy == nil || *rep.ResolvedBy != modID {
+				t.Errorf("got report %+v, expected resolved by %d", rep, modID)
+			}
+			posts, err := st.Posts(ctx, []int{int(postID)})
+			if err != nil {
+				t.Fatalf("querying posts: %s", err)
+			}
+			if len(posts) != 0 {
+				t.Errorf("got posts %+v, expected the post hidden", posts)
+			}
+
+			entries, err := st.ModerationLog(ctx, time.Now().Add(time.Hour), 10)
+			if err != nil {
+				t.Fatalf("querying moderation log: %s", err)
+			}
+			if len(entries) != 1 || entries[0].Action != actionHide || entries[0].Note != "hidden" {
+				t.Errorf("got entries %+v, expected the hiding", entries)
+			}
+
+			_, err = st.Report(ctx, reportIDs[1]+1)
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding missing report: got %v, expected sql.ErrNoRows", err)
+			}
+		},
+	},
+	{
+		name: "exports",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			aliceID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			bobID := mustCreateUser(t, ctx, st, "sub|bob", "bob")
+			postID, _, _, err := st.CreatePost(ctx, aliceID, post{Text: "post"}, true)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+			_, _, _, err = st.CreateComment(ctx, bobID, postID, "comment")
+			if err != nil {
+				t.Fatalf("creating comment: %s", err)
+			}
+			err = st.Like(ctx, bobID, postID)
+			if err != nil {
+				t.Fatalf("liking post: %s", err)
+			}
+
+			// Asking for an export while one is pending returns it.
+			first, created, err := st.CreateExport(ctx, bobID)
+			if err != nil || !created {
+				t.Fatalf("creating export: got %t, %v", created, err)
+			}
+			second, created, err := st.CreateExport(ctx, bobID)
+			if err != nil || created || second.ID != first.ID {
+				t.Errorf("creating second export: got %+v, %t, %v, expected %d", second, created, err, first.ID)
+			}
+
+			err = st.CompleteExport(ctx, first.ID, exportReady, "")
+			if err != nil {
+				t.Fatalf("completing export: %s", err)
+			}
+			e, err := st.Export(ctx, bobID, int64(first.ID))
+			if err != nil {
+				t.Fatalf("finding export: %s", err)
+			}
+			if e.Status != exportReady || e.CompletedAt == nil {
+				t.Errorf("got export %+v, expected it ready", e)
+			}
+			_, err = st.Export(ctx, aliceID, int64(first.ID))
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding export of another user: got %v, expected sql.ErrNoRows", err)
+			}
+
+			pending, _, err := st.CreateExport(ctx, aliceID)
+			if err != nil {
+				t.Fatalf("creating export: %s", err)
+			}
+			err = st.FailPendingExports(ctx)
+			if err != nil {
+				t.Fatalf("failing pending exports: %s", err)
+			}
+			e, err = st.Export(ctx, aliceID, int64(pending.ID))
+			if err != nil {
+				t.Fatalf("finding export: %s", err)
+			}
+			if e.Status != exportFailed || e.Error != "interrupted" {
+				t.Errorf("got export %+v, expected it interrupted", e)
+			}
+
+			expired, err := st.ExpiredExports(ctx, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatalf("querying expired exports: %s", err)
+			}
+			sort.Ints(expired)
+			if expected := []int{first.ID, pending.ID}; !reflect.DeepEqual(expired, expected) {
+				t.Errorf("got expired exports %v, expected %v", expired, expected)
+			}
+			err = st.DeleteExport(ctx, first.ID)
+			if err != nil {
+				t.Fatalf("deleting export: %s", err)
+			}
+			_, err = st.Export(ctx, bobID, int64(first.ID))
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding deleted export: got %v, expected sql.ErrNoRows", err)
+			}
+
+			profile, err := st.TakeoutProfile(ctx, bobID)
+			if err != nil {
+				t.Fatalf("querying profile: %s", err)
+			}
+			if expected := (takeoutProfile{ID: bobID, Sub: "sub|bob", Name: "bob", Role: roleUser}); profile != expected {
+				t.Errorf("got profile %+v, expected %+v", profile, expected)
+			}
+			posts, err := st.TakeoutPosts(ctx, aliceID)
+			if err != nil {
+				t.Fatalf("querying posts: %s", err)
+			}
+			if len(posts) != 1 || posts[0].ID != int(postID) {
+				t.Errorf("got posts %+v, expected %d", posts, postID)
+			}
+			postComments, err := st.TakeoutPostComments(ctx, []int{int(postID)})
+			if err != nil {
+				t.Fatalf("querying post comments: %s", err)
+			}
+			if c := postComments[int(postID)]; len(c) != 1 || c[0].UserName != "bob" {
+				t.Errorf("got comments %+v, expected bob's", c)
+			}
+			comments, err := st.TakeoutComments(ctx, bobID)
+			if err != nil {
+				t.Fatalf("querying comments: %s", err)
+			}
+			if len(comments) != 1 || comments[0].PostID != int(postID) || comments[0].Text != "comment" {
+				t.Errorf("got comments %+v, expected bob's", comments)
+			}
+			likes, err := st.TakeoutLikes(ctx, bobID)
+			if err != nil {
+				t.Fatalf("querying likes: %s", err)
+			}
+			if expected := []takeoutPostLink{{PostID: int(postID), UserName: "alice"}}; !reflect.DeepEqual(likes, expected) {
+				t.Errorf("got likes %+v, expected %+v", likes, expected)
+			}
+		},
+	},
+	{
+		name: "imports",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			userID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			postID, _, _, err := st.CreatePost(ctx, userID, post{Text: "post"}, false)
+			if err != nil {
+				t.Fatalf("creating post: %s", err)
+			}
+
+			_, err = st.ImportedPost(ctx, userID, "instagram", "1")
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding missing import: got %v, expected sql.ErrNoRows", err)
+			}
+			err = st.RecordImport(ctx, userID, "instagram", "1", postID)
+			if err != nil {
+				t.Fatalf("recording import: %s", err)
+			}
+			imported, err := st.ImportedPost(ctx, userID, "instagram", "1")
+			if err != nil {
+				t.Fatalf("finding import: %s", err)
+			}
+			if imported != postID {
+				t.Errorf("got post %d, expected %d", imported, postID)
+			}
+
+			// The imports go with their posts.
+			err = st.DeletePost(ctx, postID)
+			if err != nil {
+				t.Fatalf("deleting post: %s", err)
+			}
+			_, err = st.ImportedPost(ctx, userID, "instagram", "1")
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("finding import of deleted post: got %v, expected sql.ErrNoRows", err)
+			}
+		},
+	},
+	{
+		name: "content version",
+		run: func(t *testing.T, ctx context.Context, st Store) {
+			aliceID := mustCreateUser(t, ctx, st, "sub|alice", "alice")
+			version := mustContentVersion(t, ctx, st)
+
+			for _, step := range []struct {
+				name  string
+				write func() error
+			}{
+				{name: "post", write: func() error {
+					_, _, _, err := st.CreatePost(ctx, aliceID, post{Text: "post"}, true)
+					return err
+				}},
+				{name: "like", write: func() error { return st.Like(ctx, aliceID, 1) }},
+				{name: "comment", write: func() error {
+					_, _, _, err := st.CreateComment(ctx, aliceID, 1, "comment")
+					return err
+				}},
+				{name: "rename", write: func() error { return st.RenameUser(ctx, aliceID, "alicia") }},
+				{name: "deletion", write: func() error { return st.DeletePost(ctx, 1) }},
+			} {
+				err := step.write()
+				if err != nil {
+					t.Fatalf("writing %s: %s", step.name, err)
+				}
+				next := mustContentVersion(t, ctx, st)
+				if next <= version {
+					t.Errorf("%s: got version %d, expected more than %d", step.name, next, version)
+				}
+				version = next
+			}
+		},
+	},
+}
+
+// TestStore runs the store tests on SQLite and PostgreSQL. The PostgreSQL
+// database is the one of the PHOTOTRAIL_TEST_DATABASE_URL environment
+// variable, which is emptied by each test, or a server spawned for the tests
+// if initdb and pg_ctl are installed.
+func TestStore(t *testing.T) {
+	for _, db := range []struct {
+		name string
+		url  func(t *testing.T) string
+	}{
+		{name: "sqlite", url: func(*testing.T) string { return "" }},
+		{name: "postgres", url: testPostgres},
+	} {
+		t.Run(db.name, func(t *testing.T) {
+			databaseURL := db.url(t)
+			for _, tc := range storeTests {
+				t.Run(tc.name, func(t *testing.T) {
+					s := newTestServiceOn(t, databaseURL)
+					tc.run(t, context.Background(), s.store)
+				})
+			}
+		})
+	}
+}
+
+// testPostgres returns the URL of the PostgreSQL database of the tests,
+// spawning a server in a temporary directory for the duration of the test if
+// none is given. The test is skipped if PostgreSQL isn't installed.
+func testPostgres(t *testing.T) string {
+	if databaseURL := os.Getenv("PHOTOTRAIL_TEST_DATABASE_URL"); databaseURL != "" {
+		return databaseURL
+	}
+
+	for _, name := range []string{"initdb", "pg_ctl"} {
+		_, err := exec.LookPath(name)
+		if err != nil {
+			t.Skipf("%s not found, set PHOTOTRAIL_TEST_DATABASE_URL or install PostgreSQL to run the tests on PostgreSQL", name)
+		}
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("PostgreSQL can't be spawned as root, set PHOTOTRAIL_TEST_DATABASE_URL to run the tests on PostgreSQL")
+	}
+
+	// The server only listens on a socket of its directory, so it doesn't
+	// conflict with another one.
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	run := func(name string, args ...string) {
+		t.Helper()
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("running %s: %s\n%s", name, err, out)
+		}
+	}
+	run("initdb", "-D", data, "-U", "phototrail", "-A", "trust", "-E", "UTF8")
+	run("pg_ctl", "start", "-w", "-D", data, "-l", filepath.Join(dir, "log"), "-o", fmt.Sprintf("-k %s -c listen_addresses='' -F", dir))
+	t.Cleanup(func() {
+		run("pg_ctl", "stop", "-D", data, "-m", "immediate")
+	})
+
+	return fmt.Sprintf("postgres://phototrail@/postgres?host=%s&sslmode=disable", url.QueryEscape(dir))
+}
+
+// mustCreateUser creates a user, or fails the test.
+func mustCreateUser(t *testing.T, ctx context.Context, st Store, sub, name string) int {
+	t.Helper()
+
+	id, err := st.CreateUser(ctx, sub, name)
+	if err != nil {
+		t.Fatalf("creating user %s: %s", name, err)
+	}
+	return id
+}
+
+// mustContentVersion returns the content version of the store, or fails the
+// test.
+func mustContentVersion(t *testing.T, ctx context.Context, st Store) uint64 {
+	t.Helper()
+
+	version, err := st.ContentVersion(ctx)
+	if err != nil {
+		t.Fatalf("querying content version: %s", err)
+	}
+	return version
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+)
+
+// entityPattern matches the hashtags and mentions in a text. An entity must
+// be at the start of the text or preceded by a character that can't be part
+// of a word, so emails addresses or anchors in URLs aren't picked up.
+var entityPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_#@&/])([#@])([\p{L}\p{N}_]+)`)
+
+// parseEntities extracts the hashtags and mentioned user names from a text.
+// Both lists are deduplicated and keep the order of first appearance. Tags are
+// lowercased so #Paris and #paris are the same tag.
+func parseEntities(text string) (tags []string, names []string) {
+	seen := make(map[string]bool)
+	for _, m := range entityPattern.FindAllStringSubmatch(text, -1) {
+		value := m[2]
+		if m[1] == "#" {
+			value = strings.ToLower(value)
+		}
+
+		key := m[1] + strings.ToLower(value)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if m[1] == "#" {
+			tags = append(tags, value)
+		} else {
+			names = append(names, value)
+		}
+	}
+	return tags, names
+}
+
+// nullable returns a value suitable as a query parameter for an optional
+// reference, where the zero ID means NULL.
+func nullable(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// indexEntities parses the text of a post (if commentID is zero) or a comment
+// and replaces its stored tags and mentions. Users mentioned for the first time
+// in this text are notified, unless notify is false. It runs in the
+// transaction writing the text, so a text is never stored without its
+// entities, and is meant to be called each time the text is written.
+func indexEntities(ctx context.Context, tx *sqlx.Tx, authorID, postID, commentID int, text string, notify bool) ([]string, []mention, error) {
+	tags, names := parseEntities(text)
+
+	// Keep the previously mentioned and notified users so editing a text
+	// doesn't notify them a second time, even if they were removed from the
+	// text meanwhile.
+	var previous []int
+	err := tx.SelectContext(ctx, &previous, `
+		select user_id
+		from mentions
+		where post_id = ?
+		and coalesce(comment_id, 0) = ?
+		union
+		select user_id
+		from notifications
+		where kind = 'mention'
+		and post_id = ?
+		and coalesce(comment_id, 0) = ?
+	`, postID, commentID, postID, commentID)
+	if err != nil {
+		return nil, nil, wrap(err, "querying previous mentions")
+	}
+	notified := make(map[int]bool)
+	for _, id := range previous {
+		notified[id] = true
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		delete from tags
+		where post_id = ?
+		and coalesce(comment_id, 0) = ?
+	`, postID, commentID)
+	if err != nil {
+		return nil, nil, wrap(err, "removing previous tags")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		delete from mentions
+		where post_id = ?
+		and coalesce(comment_id, 0) = ?
+	`, postID, commentID)
+	if err != nil {
+		return nil, nil, wrap(err, "removing previous mentions")
+	}
+
+	for _, tag := range tags {
+		_, err = tx.ExecContext(ctx, `
+			insert into tags (post_id, comment_id, tag)
+			values (?, ?, ?)
+		`, postID, nullable(commentID), tag)
+		if err != nil {
+			return nil, nil, wrap(err, "inserting tag %q", tag)
+		}
+	}
+
+	// Mentions of unknown users are ignored, they are just text.
+	var mentions []mention
+	for _, name := range names {
+		var m mention
+		err = tx.GetContext(ctx, &m, `
+			select id as user_id, name as user_name
+			from users
+			where lower(name) = lower(?)
+			order by id
+			limit 1
+		`, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, wrap(err, "finding mentioned user %q", name)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			insert into mentions (post_id, comment_id, user_id)
+			values (?, ?, ?)
+		`, postID, nullable(commentID), m.UserID)
+		if err != nil {
+			return nil, nil, wrap(err, "inserting mention of %q", name)
+		}
+		mentions = append(mentions, m)
+
+		if !notify || m.UserID == authorID || notified[m.UserID] {
+			continue
+		}
+		notified[m.UserID] = true
+
+		_, err = tx.ExecContext(ctx, `
+			insert into notifications (user_id, actor_id, kind, post_id, comment_id)
+			values (?, ?, 'mention', ?, ?)
+		`, m.UserID, authorID, postID, nullable(commentID))
+		if err != nil {
+			return nil, nil, wrap(err, "notifying %q", name)
+		}
+	}
+
+	return tags, mentions, nil
+}
+
+// entityKey identifies the post or comment an entity belongs to. The
+// CommentID is zero for the post's own entities.
+type entityKey struct {
+	PostID    int
+	CommentID int
+}
+
+// entities holds the tags and mentions of a set of posts and comments.
+type entities struct {
+	tags     map[entityKey][]string
+	mentions map[entityKey][]mention
+}
+
+// queryEntities retrieves the tags and mentions of the given posts and all
+// their comments.
+func (s *service) queryEntities(ctx context.Context, postIDs []int) (entities, error) {
+	e := entities{
+		tags:     make(map[entityKey][]string),
+		mentions: make(map[entityKey][]mention),
+	}
+
+	query, args, err := sqlx.In(`
+		select post_id, coalesce(comment_id, 0) as comment_id, tag
+		from tags
+		where post_id in (?)
+		order by rowid
+	`, postIDs)
+	if err != nil {
+		return e, wrap(err, "building tags query")
+	}
+	var tags []struct {
+		PostID    int    `db:"post_id"`
+		CommentID int    `db:"comment_id"`
+		Tag       string `db:"tag"`
+	}
+	err = s.reader.SelectContext(ctx, &tags, query, args...)
+	if err != nil {
+		return e, wrap(err, "querying tags")
+	}
+	for _, t := range tags {
+		key := entityKey{PostID: t.PostID, CommentID: t.CommentID}
+		e.tags[key] = append(e.tags[key], t.Tag)
+	}
+
+	query, args, err = sqlx.In(`
+		select m.post_id, coalesce(m.comment_id, 0) as comment_id, u.id as user_id, u.name as user_name
+		from mentions as m
+		left join users as u on m.user_id = u.id
+		where m.post_id in (?)
+		order by m.rowid
+	`, postIDs)
+	if err != nil {
+		return e, wrap(err, "building mentions query")
+	}
+	var mentions []mention
+	err = s.reader.SelectContext(ctx, &mentions, query, args...)
+	if err != nil {
+		return e, wrap(err, "querying mentions")
+	}
+	for _, m := range mentions {
+		key := entityKey{PostID: m.PostID, CommentID: m.CommentID}
+		e.mentions[key] = append(e.mentions[key], m)
+	}
+
+	return e, nil
+}
+
+func (s *service) tagPosts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	_, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	pg, err := s.parsePage(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Only the tags of the posts themselves are considered, a tag in a
+	// comment doesn't make the post part of the tag.
+	f, err := s.listPosts(r.Context(), pg, `and id in (
+		select post_id
+		from tags
+		where tag = ?
+		and comment_id is null
+	)`, strings.ToLower(p.ByName("tag")))
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "querying tag"))
+		return
+	}
+
+	write(w, http.StatusOK, f)
+}
+
+type notification struct {
+	ID        int       `json:"id"                   db:"id"`
+	Kind      string    `json:"kind"                 db:"kind"`
+	ActorID   int       `json:"actor_id"             db:"actor_id"`
+	ActorName string    `json:"actor_name"           db:"actor_name"`
+	PostID    int       `json:"post_id,omitempty"    db:"post_id"`
+	CommentID int       `json:"comment_id,omitempty" db:"comment_id"`
+	CreatedAt time.Time `json:"created_at"           db:"created_at"`
+	Read      bool      `json:"read"                 db:"read"`
+}
+
+func (s *service) notifications(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	from, limit, err := s.parsePagination(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	var notifications = []notification{}
+	err = s.database.SelectContext(r.Context(), &notifications, `
+		select n.id, n.kind, n.actor_id, a.name as actor_name,
+			coalesce(n.post_id, 0) as post_id, coalesce(n.comment_id, 0) as comment_id,
+			n.created_at, n.read_at is not null as read
+		from notifications as n
+		left join users as a on n.actor_id = a.id
+		where n.user_id = ?
+		and n.created_at < ?
+		order by n.created_at desc
+		limit ?
+	`, u.ID, from, limit)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "querying notifications"))
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{
+		"notifications": notifications,
+	})
+}
+
+func (s *service) readNotifications(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	u, err := s.authenticateRequest(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusUnauthorized, wrap(err, "authenticating request"))
+		return
+	}
+
+	_, err = s.database.ExecContext(r.Context(), `
+		update notifications
+		set read_at = current_timestamp
+		where user_id = ?
+		and read_at is null
+	`, u.ID)
+	if err != nil {
+		s.writeError(w, r, http.StatusInternalServerError, wrap(err, "marking notifications as read"))
+		return
+	}
+
+	write(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
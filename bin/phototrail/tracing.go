@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// initTracing configures the export of the traces. Without exporter, the
+// spans are still created but never recorded.
+func (s *service) initTracing(ctx context.Context) error {
+	s.tracer = otel.Tracer("github.com/elwinar/phototrail")
+	s.client = &http.Client{
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch s.traceExporter {
+	case "":
+		return nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+	case "otlp":
+		// The exporter is configured by the standard OTEL_EXPORTER_OTLP_*
+		// environment variables.
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return fmt.Errorf("unknown trace exporter %q", s.traceExporter)
+	}
+	if err != nil {
+		return wrap(err, "creating trace exporter")
+	}
+
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("phototrail"),
+			semconv.ServiceVersionKey.String(Version),
+		)),
+	)
+	otel.SetTracerProvider(s.tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return nil
+}
+
+// shutdownTracing exports the spans not exported yet.
+func (s *service) shutdownTracing() {
+	if s.tracerProvider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.tracerProvider.Shutdown(ctx)
+	if err != nil {
+		s.logger.Error("shutting tracing down", "err", err)
+	}
+}
+
+// traceRequest wraps the handler so each request gets a span, named after its
+// route.
+func (s *service) traceRequest(router *httprouter.Router, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "request", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		route := "unmatched"
+		if h, params, _ := router.Lookup(r.Method, r.URL.Path); h != nil {
+			route = routePattern(r.URL.Path, params)
+		}
+		return r.Method + " " + route
+	}))
+}
+
+// log returns the logger of the service with the trace and the ID of the
+// request of the context, so the logs of a request can be matched with its
+// trace and the errors reported by the clients.
+func (s *service) log(ctx context.Context) log15.Logger {
+	var fields []interface{}
+	if id := requestID(ctx); id != "" {
+		fields = append(fields, "request_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields = append(fields, "trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	if len(fields) == 0 {
+		return s.logger
+	}
+	return s.logger.New(fields...)
+}
+
+// observeQuery records the metrics and the span of a database statement.
+func (s *service) observeQuery(ctx context.Context, query string, start time.Time, err error) {
+	s.metrics.observeQuery(query, time.Since(start), err)
+
+	_, span := s.tracer.Start(ctx, "sql "+queryOperation(query),
+		trace.WithTimestamp(start),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			s.dbSystem(),
+			semconv.DBStatementKey.String(query),
+		),
+	)
+	endSpan(span, err)
+}
+
+// dbSystem returns the attribute of the database system of the spans.
+func (s *service) dbSystem() attribute.KeyValue {
+	if s.isPostgres() {
+		return semconv.DBSystemPostgreSQL
+	}
+	return semconv.DBSystemSqlite
+}
+
+// endSpan ends the span, recording the error if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
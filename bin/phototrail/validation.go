@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// decodePayload reads the JSON payload of a request and validates it. The
+// unknown fields are refused, so the mistakes of the clients don't go
+// unnoticed.
+func decodePayload(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return invalidPayload(err)
+	}
+	return validatePayload(v)
+}
+
+// validatePayload normalises the strings of a payload to the NFC form, so the
+// same text is always stored the same way, and checks the fields against the
+// rules of their validate tag:
+//
+//	trim      removes the leading and trailing spaces
+//	required  refuses the zero value
+//	max=N     refuses the strings longer than N characters
+//
+// The rules are applied in order, and the first one failing is reported.
+func validatePayload(v interface{}) error {
+	value := reflect.ValueOf(v).Elem()
+
+	var fields []fieldError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+
+		f := value.Field(i)
+		if f.Kind() == reflect.String {
+			f.SetString(norm.NFC.String(f.String()))
+		}
+
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		for _, rule := range strings.Split(tag, ",") {
+			fe := checkRule(f, name, rule)
+			if fe != nil {
+				fields = append(fields, *fe)
+				break
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(fields))
+	for i, fe := range fields {
+		messages[i] = fe.Message
+	}
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    "invalid_payload",
+		message: strings.Join(messages, ", "),
+		fields:  fields,
+	}
+}
+
+// checkRule applies a validation rule on the value of a field, and returns the
+// failure if any. Unknown rules are programming errors, and panic.
+func checkRule(f reflect.Value, name, rule string) *fieldError {
+	rule, arg := splitRule(rule)
+	switch rule {
+	case "trim":
+		f.SetString(strings.TrimSpace(f.String()))
+	case "required":
+		if f.IsZero() {
+			return &fieldError{Field: name, Code: "required", Message: "missing " + name}
+		}
+	case "max":
+		max, err := strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Sprintf("invalid max rule for %s: %s", name, err))
+		}
+		if utf8.RuneCountInString(f.String()) > max {
+			return &fieldError{Field: name, Code: "too_long", Message: fmt.Sprintf("%s longer than %d characters", name, max)}
+		}
+	default:
+		panic(fmt.Sprintf("unknown validation rule %q for %s", rule, name))
+	}
+	return nil
+}
+
+// splitRule separates a validation rule from its argument.
+func splitRule(rule string) (string, string) {
+	i := strings.Index(rule, "=")
+	if i == -1 {
+		return rule, ""
+	}
+	return rule[:i], rule[i+1:]
+}
+
+// jsonName returns the name of the field in the JSON encoding of its struct,
+// or false if the field isn't encoded.
+func jsonName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+
+	tag := strings.Split(field.Tag.Get("json"), ",")
+	if tag[0] == "-" {
+		return "", false
+	}
+	if tag[0] != "" {
+		return tag[0], true
+	}
+	return field.Name, true
+}
@@ -57,7 +57,7 @@ function useFeed() {
 
   const likeHandler = useCallback(
     function likeHandler(postID) {
-      const post = pages.find((page) => page[postID] !== undefined)[postID];
+      const post = pages.find((page) => page.posts[postID] !== undefined).posts[postID];
 
       if (post.likes && post.likes.find((l) => l.user_id === document.session.user_id)) {
         api.unlike(postID).then(() => {
@@ -211,7 +211,7 @@ function flattenFeedPages(pages) {
   }
 
   const res = pages.reduce((acc, curr) => {
-    return { ...acc, ...curr };
+    return { ...acc, ...curr.posts };
   }, {});
 
   if (res.length == 0) {
@@ -229,15 +229,13 @@ const getKey = (index, previous) => {
     return key;
   }
 
-  // If there is no previous page, or if the previous page was uncomplete,
+  // If there is no previous page, or if the previous page was the last one,
   // return null to cancel the fetch.
-  if (!previous || Object.keys(previous).length !== document.config.pageSize) {
+  if (!previous || !previous.next_cursor) {
     return null;
   }
 
-  // Use the date of the oldest post as cursor.
-  const oldest = Object.values(previous).sort((a, b) => (a.created_at > b.created_at ? 1 : -1))[0];
-  key += `&from=${oldest.created_at}`;
+  key += `&cursor=${previous.next_cursor}`;
 
   return key;
 };
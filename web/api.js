@@ -1,6 +1,6 @@
 // first param is the key from swr
 function getFeed(params) {
-  return call(`${document.config.baseURL}/feed?${params}`, {
+  return call(`${document.config.baseURL}/api/v1/feed?${params}`, {
     method: "GET",
   })
     .then((res) => res.json())
@@ -9,19 +9,17 @@ function getFeed(params) {
         throw new Error(data.error);
       }
 
-      if (!data.posts) {
-        return {};
-      }
-
-      return data.posts.reduce((acc, curr) => {
+      const posts = (data.posts || []).reduce((acc, curr) => {
         acc[curr.id] = curr;
         return acc;
       }, {});
+
+      return { posts, next_cursor: data.next_cursor };
     });
 }
 
 function createPost({ text, images = [] }) {
-  return call(`${document.config.baseURL}/posts`, {
+  return call(`${document.config.baseURL}/api/v1/posts`, {
     method: "POST",
     body: JSON.stringify({ text }),
   })
@@ -49,7 +47,7 @@ function createPost({ text, images = [] }) {
 }
 
 function uploadImage(postID, image) {
-  return call(`${document.config.baseURL}/posts/${postID}/images`, {
+  return call(`${document.config.baseURL}/api/v1/posts/${postID}/images`, {
     method: "POST",
     body: image,
   })
@@ -64,7 +62,7 @@ function uploadImage(postID, image) {
 }
 
 function deletePost(postID) {
-  return call(`${document.config.baseURL}/posts/${postID}`, {
+  return call(`${document.config.baseURL}/api/v1/posts/${postID}`, {
     method: "DELETE",
   })
     .then((res) => res.json())
@@ -77,7 +75,7 @@ function deletePost(postID) {
 }
 
 function like(postID) {
-  return call(`${document.config.baseURL}/posts/${postID}/like`, {
+  return call(`${document.config.baseURL}/api/v1/posts/${postID}/like`, {
     method: "POST",
   })
     .then((res) => res.json())
@@ -90,7 +88,7 @@ function like(postID) {
 }
 
 function unlike(postID) {
-  return call(`${document.config.baseURL}/posts/${postID}/like`, {
+  return call(`${document.config.baseURL}/api/v1/posts/${postID}/like`, {
     method: "DELETE",
   })
     .then((res) => res.json())
@@ -103,7 +101,7 @@ function unlike(postID) {
 }
 
 function createComment(postID, text) {
-  return call(`${document.config.baseURL}/posts/${postID}/comments`, {
+  return call(`${document.config.baseURL}/api/v1/posts/${postID}/comments`, {
     method: "POST",
     body: JSON.stringify({ text }),
   })
@@ -118,7 +116,7 @@ function createComment(postID, text) {
 }
 
 function deleteComment(postID, commentID) {
-  return call(`${document.config.baseURL}/posts/${postID}/comments/${commentID}`, {
+  return call(`${document.config.baseURL}/api/v1/posts/${postID}/comments/${commentID}`, {
     method: "DELETE",
   })
     .then((res) => res.json())
@@ -144,7 +142,7 @@ function call(url, options) {
     }
 
     // Use the refresh token to get a new access token.
-    return fetch(`${document.config.baseURL}/refresh`, {
+    return fetch(`${document.config.baseURL}/api/v1/refresh`, {
       method: "POST",
       body: JSON.stringify({
         refresh_token: document.session.refresh_token,
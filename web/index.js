@@ -48,13 +48,13 @@ if (!document.config) {
   document.session = JSON.parse(localStorage.getItem("session"));
   if (!document.session || !document.session.token || document.session.expiration < Date.now()) {
     localStorage.clear();
-    window.location.replace(`${document.config.baseURL}/login`);
+    window.location.replace(`${document.config.baseURL}/api/v1/login`);
     return;
   }
 
   // Retrieve the user information. This is done on every load to avoid having
   // issues when refreshing the database.
-  const user = await fetch(`${document.config.baseURL}/me`, {
+  const user = await fetch(`${document.config.baseURL}/api/v1/me`, {
     method: "GET",
     headers: {
       Authorization: "Bearer " + document.session.token,
@@ -85,7 +85,7 @@ if (!document.config) {
         logo={logo}
         onLogout={() => {
           localStorage.clear();
-          window.location.replace(`${document.config.baseURL}/logout`);
+          window.location.replace(`${document.config.baseURL}/api/v1/logout`);
         }}
       />
       <AppBoundary>